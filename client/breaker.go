@@ -1,19 +1,27 @@
 package client
 
 import (
-	"sync/atomic"
+	"fmt"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/log"
+	"sync"
 	"time"
 )
 
+// Breaker 建连熔断器,所有服务端共用一个,只在建连与选择服务端时使用
+//
+// Deprecated: 使用 Option.CircuitBreaker,按服务端(或方法)熔断
 type Breaker interface {
 	Ready() bool
 	Fail()
 	Success()
 }
 
+// Deprecated: 使用 Option.CircuitBreaker
 var DefaultBreaker = NewSimpleBreaker(3, 10*time.Second)
 
 type SimpleBreaker struct {
+	mu               sync.Mutex
 	lastFailureTime  time.Time
 	failures         uint64
 	failureThreshold uint64
@@ -28,24 +36,335 @@ func NewSimpleBreaker(failThreshold uint64, window time.Duration) Breaker {
 }
 
 func (cb *SimpleBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
 	if time.Since(cb.lastFailureTime) > cb.window {
 		cb.reset()
 		return true
 	}
-
-	failures := atomic.LoadUint64(&cb.failures)
-	return failures < cb.failureThreshold
+	return cb.failures < cb.failureThreshold
 }
 
 func (cb *SimpleBreaker) Success() {
+	cb.mu.Lock()
 	cb.reset()
+	cb.mu.Unlock()
 }
 func (cb *SimpleBreaker) Fail() {
-	atomic.AddUint64(&cb.failures, 1)
+	cb.mu.Lock()
+	cb.failures++
 	cb.lastFailureTime = time.Now()
+	cb.mu.Unlock()
 }
 
+// reset 调用方需持有 cb.mu
 func (cb *SimpleBreaker) reset() {
-	atomic.StoreUint64(&cb.failures, 0)
+	cb.failures = 0
 	cb.lastFailureTime = time.Now()
 }
+
+// 熔断策略的默认值
+const (
+	DefaultBreakerWindow           = 10 * time.Second
+	DefaultBreakerMinRequests      = 20
+	DefaultBreakerFailureRate      = 50
+	DefaultBreakerSlowCallRate     = 100
+	DefaultBreakerOpenTimeout      = 10 * time.Second
+	DefaultBreakerHalfOpenRequests = 5
+	//breakerBuckets 滑动窗口的分桶数
+	breakerBuckets = 10
+)
+
+// CircuitBreakerPolicy 熔断策略,每个服务端使用独立的熔断器。
+// 滑动窗口内失败率或慢调用率达到阈值时熔断(open),熔断的服务端不会被选择;
+// 经过 OpenTimeout 后半开(half-open),放行 HalfOpenRequests 个试探请求,
+// 全部成功后恢复(closed),任一失败或慢调用时重新熔断
+type CircuitBreakerPolicy struct {
+	//Window 统计失败率的滑动窗口
+	Window time.Duration
+	//MinRequests 窗口内请求数达到该值后才判断是否熔断
+	MinRequests int
+	//FailureRate 熔断的失败率百分比,只统计 Unavailable 与 DeadlineExceeded
+	FailureRate float64
+	//SlowCallDuration 耗时不低于该值的调用为慢调用,0 表示不统计慢调用
+	SlowCallDuration time.Duration
+	//SlowCallRate 熔断的慢调用率百分比
+	SlowCallRate     float64
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+	//PerMethod 服务端的每个方法使用独立的熔断器,否则同一服务端的方法共用
+	PerMethod bool
+	//Methods 按 "path.method" 覆盖的策略,这些方法使用独立的熔断器
+	Methods map[string]*CircuitBreakerPolicy
+}
+
+// forMethod 返回方法生效的策略及熔断器名,名为 "" 时使用服务端共用的熔断器,p 为 nil 时返回 nil
+func (p *CircuitBreakerPolicy) forMethod(path, method string) (*CircuitBreakerPolicy, string) {
+	if p == nil {
+		return nil, ""
+	}
+	name := path + "." + method
+	if mp, ok := p.Methods[name]; ok {
+		return mp, name
+	}
+	if p.PerMethod {
+		return p, name
+	}
+	return p, ""
+}
+
+func (p *CircuitBreakerPolicy) window() time.Duration {
+	if p.Window <= 0 {
+		return DefaultBreakerWindow
+	}
+	return p.Window
+}
+
+func (p *CircuitBreakerPolicy) minRequests() int {
+	if p.MinRequests <= 0 {
+		return DefaultBreakerMinRequests
+	}
+	return p.MinRequests
+}
+
+func (p *CircuitBreakerPolicy) failureRate() float64 {
+	if p.FailureRate <= 0 {
+		return DefaultBreakerFailureRate
+	}
+	return p.FailureRate
+}
+
+func (p *CircuitBreakerPolicy) slowCallRate() float64 {
+	if p.SlowCallRate <= 0 {
+		return DefaultBreakerSlowCallRate
+	}
+	return p.SlowCallRate
+}
+
+func (p *CircuitBreakerPolicy) openTimeout() time.Duration {
+	if p.OpenTimeout <= 0 {
+		return DefaultBreakerOpenTimeout
+	}
+	return p.OpenTimeout
+}
+
+func (p *CircuitBreakerPolicy) halfOpenRequests() int {
+	if p.HalfOpenRequests <= 0 {
+		return DefaultBreakerHalfOpenRequests
+	}
+	return p.HalfOpenRequests
+}
+
+// slow 耗时为 d 的调用是否为慢调用
+func (p *CircuitBreakerPolicy) slow(d time.Duration) bool {
+	return p.SlowCallDuration > 0 && d >= p.SlowCallDuration
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("breakerState(%d)", int(s))
+}
+
+// breakerBucket 滑动窗口的一个分桶,slot 为分桶对应的时间片
+type breakerBucket struct {
+	slot     int64
+	total    int
+	failures int
+	slow     int
+}
+
+// circuitBreaker 一个服务端(或方法)的熔断器
+type circuitBreaker struct {
+	name   string
+	policy *CircuitBreakerPolicy
+	mu     sync.Mutex
+	state  breakerState
+	//generation 状态变化时递增,之前放行的请求的结果不再统计
+	generation uint64
+	buckets    [breakerBuckets]breakerBucket
+	openedAt   time.Time
+	//trials 半开时在途的试探请求数,successes 成功的试探请求数
+	trials    int
+	successes int
+}
+
+func newCircuitBreaker(name string, policy *CircuitBreakerPolicy) *circuitBreaker {
+	return &circuitBreaker{name: name, policy: policy}
+}
+
+// ready 是否可以选择该服务端,不改变状态
+func (b *circuitBreaker) ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return now.Sub(b.openedAt) >= b.policy.openTimeout()
+	case breakerHalfOpen:
+		return b.trials < b.policy.halfOpenRequests()
+	}
+	return true
+}
+
+// allow 放行一个请求,返回的 generation 用于 done
+func (b *circuitBreaker) allow(now time.Time) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < b.policy.openTimeout() {
+			return 0, false
+		}
+		b.setState(breakerHalfOpen, now)
+	}
+	if b.state == breakerHalfOpen {
+		if b.trials >= b.policy.halfOpenRequests() {
+			return 0, false
+		}
+		b.trials++
+	}
+	return b.generation, true
+}
+
+// done 记录 allow 放行的请求的结果,被取消的请求不统计
+func (b *circuitBreaker) done(generation uint64, err error, cost time.Duration, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	canceled := errors.CodeOf(err) == errors.Canceled
+	failed, slow := healthFailure(err), b.policy.slow(cost)
+	switch b.state {
+	case breakerClosed:
+		if canceled {
+			return
+		}
+		b.record(failed, slow, now)
+		if b.tripped(now) {
+			b.setState(breakerOpen, now)
+		}
+	case breakerHalfOpen:
+		b.trials--
+		if canceled {
+			return
+		}
+		if failed || slow {
+			b.setState(breakerOpen, now)
+			return
+		}
+		if b.successes++; b.successes >= b.policy.halfOpenRequests() {
+			b.setState(breakerClosed, now)
+		}
+	}
+}
+
+// slot 返回 now 所在的时间片
+func (b *circuitBreaker) slot(now time.Time) int64 {
+	size := int64(b.policy.window()) / breakerBuckets
+	if size <= 0 {
+		size = 1
+	}
+	return now.UnixNano() / size
+}
+
+// record 把结果计入 now 所在的分桶,调用方需持有 b.mu
+func (b *circuitBreaker) record(failed, slow bool, now time.Time) {
+	slot := b.slot(now)
+	bucket := &b.buckets[slot%breakerBuckets]
+	if bucket.slot != slot {
+		*bucket = breakerBucket{slot: slot}
+	}
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+}
+
+// tripped 滑动窗口内失败率或慢调用率是否达到阈值,调用方需持有 b.mu
+func (b *circuitBreaker) tripped(now time.Time) bool {
+	slot := b.slot(now)
+	var total, failures, slow int
+	for _, bucket := range b.buckets {
+		if bucket.slot > slot-breakerBuckets && bucket.slot <= slot {
+			total += bucket.total
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	if total == 0 || total < b.policy.minRequests() {
+		return false
+	}
+	if float64(failures)*100 >= float64(total)*b.policy.failureRate() {
+		return true
+	}
+	return b.policy.SlowCallDuration > 0 && float64(slow)*100 >= float64(total)*b.policy.slowCallRate()
+}
+
+// setState 切换状态并清空统计,调用方需持有 b.mu
+func (b *circuitBreaker) setState(state breakerState, now time.Time) {
+	b.state = state
+	b.generation++
+	b.buckets = [breakerBuckets]breakerBucket{}
+	b.trials, b.successes = 0, 0
+	switch state {
+	case breakerOpen:
+		b.openedAt = now
+		log.Rlog.Warn("circuit breaker %v open", b.name)
+	case breakerHalfOpen:
+		log.Rlog.Debug("circuit breaker %v half-open", b.name)
+	case breakerClosed:
+		log.Rlog.Info("circuit breaker %v closed", b.name)
+	}
+}
+
+// errBreakerOpen 服务端熔断时的错误,请求未发出,可以安全重试
+func errBreakerOpen(name string) error {
+	return notSent(errors.Unavailable, fmt.Errorf("mrpc: circuit breaker %v is open", name))
+}
+
+// breaker 返回服务端 name 上 path.method 使用的熔断器,未开启熔断或服务端已删除时返回 nil
+func (c *XClient) breaker(name, path, method string) *circuitBreaker {
+	policy, key := c.option.CircuitBreaker.forMethod(path, method)
+	if policy == nil {
+		return nil
+	}
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	m, ok := c.breakers[name]
+	if !ok {
+		return nil
+	}
+	b, ok := m[key]
+	if !ok {
+		id := name
+		if len(key) > 0 {
+			id = name + "/" + key
+		}
+		b = newCircuitBreaker(id, policy)
+		m[key] = b
+	}
+	return b
+}
+
+// breakerReady 服务端 name 的熔断器是否允许调用 path.method
+func (c *XClient) breakerReady(name, path, method string) bool {
+	b := c.breaker(name, path, method)
+	return b == nil || b.ready(time.Now())
+}
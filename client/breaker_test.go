@@ -0,0 +1,308 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/lb"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New(errors.Unavailable, "unavailable")
+
+func TestSimpleBreakerConcurrent(t *testing.T) {
+	b := NewSimpleBreaker(3, time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Fail()
+				b.Ready()
+				b.Success()
+			}
+		}()
+	}
+	wg.Wait()
+	if !b.Ready() {
+		t.Fatal("expect ready after success")
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	policy := &CircuitBreakerPolicy{MinRequests: 4, FailureRate: 60, OpenTimeout: time.Second, HalfOpenRequests: 2}
+	b := newCircuitBreaker("test", policy)
+	now := time.Now()
+	call := func(err error) {
+		gen, ok := b.allow(now)
+		if !ok {
+			t.Fatalf("expect allowed in %v", b.state)
+		}
+		b.done(gen, err, 0, now)
+	}
+
+	//请求数不足时不熔断
+	call(errUnavailable)
+	call(errUnavailable)
+	call(nil)
+	if b.state != breakerClosed {
+		t.Fatalf("expect closed below min requests, got %v", b.state)
+	}
+	//业务错误不计入失败
+	call(errors.New(errors.InvalidArgument, "bad"))
+	if b.state != breakerClosed {
+		t.Fatalf("expect application errors not counted, got %v", b.state)
+	}
+	call(errUnavailable)
+	if b.state != breakerOpen || b.ready(now) {
+		t.Fatalf("expect open, got %v", b.state)
+	}
+	if _, ok := b.allow(now); ok {
+		t.Fatal("expect rejected while open")
+	}
+
+	//半开时只放行 HalfOpenRequests 个试探请求
+	now = now.Add(time.Second)
+	if !b.ready(now) {
+		t.Fatal("expect ready after open timeout")
+	}
+	g1, ok1 := b.allow(now)
+	g2, ok2 := b.allow(now)
+	if _, ok := b.allow(now); !ok1 || !ok2 || ok || b.state != breakerHalfOpen {
+		t.Fatalf("expect 2 trials in half-open, got %v %v %v %v", ok1, ok2, ok, b.state)
+	}
+	b.done(g1, nil, 0, now)
+	b.done(g2, nil, 0, now)
+	if b.state != breakerClosed {
+		t.Fatalf("expect closed after trials succeed, got %v", b.state)
+	}
+
+	//试探失败时重新熔断
+	for i := 0; i < 4; i++ {
+		call(errUnavailable)
+	}
+	now = now.Add(time.Second)
+	gen, _ := b.allow(now)
+	b.done(gen, errUnavailable, 0, now)
+	if b.state != breakerOpen || b.ready(now) {
+		t.Fatalf("expect reopen after trial fails, got %v", b.state)
+	}
+}
+
+func TestCircuitBreakerHalfOpenCanceled(t *testing.T) {
+	b := newCircuitBreaker("test", &CircuitBreakerPolicy{MinRequests: 1, OpenTimeout: time.Second, HalfOpenRequests: 1})
+	now := time.Now()
+	gen, _ := b.allow(now)
+	b.done(gen, errUnavailable, 0, now)
+	now = now.Add(time.Second)
+	gen, _ = b.allow(now)
+	if b.ready(now) {
+		t.Fatal("expect no more trials")
+	}
+	//被取消的试探请求释放名额但不计入结果
+	b.done(gen, errors.New(errors.Canceled, "canceled"), 0, now)
+	if b.state != breakerHalfOpen || !b.ready(now) {
+		t.Fatalf("expect trial released, got %v", b.state)
+	}
+}
+
+func TestCircuitBreakerStaleResult(t *testing.T) {
+	b := newCircuitBreaker("test", &CircuitBreakerPolicy{MinRequests: 2, OpenTimeout: time.Second, HalfOpenRequests: 1})
+	now := time.Now()
+	stale, _ := b.allow(now)
+	for i := 0; i < 2; i++ {
+		gen, _ := b.allow(now)
+		b.done(gen, errUnavailable, 0, now)
+	}
+	now = now.Add(time.Second)
+	gen, _ := b.allow(now)
+	//熔断前放行的请求的结果不影响半开状态
+	b.done(stale, nil, 0, now)
+	if b.state != breakerHalfOpen || b.ready(now) {
+		t.Fatalf("expect stale result ignored, got %v", b.state)
+	}
+	b.done(gen, nil, 0, now)
+	if b.state != breakerClosed {
+		t.Fatalf("expect closed, got %v", b.state)
+	}
+}
+
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	policy := &CircuitBreakerPolicy{MinRequests: 4, SlowCallDuration: 100 * time.Millisecond, SlowCallRate: 50}
+	b := newCircuitBreaker("test", policy)
+	now := time.Now()
+	for _, cost := range []time.Duration{time.Millisecond, 200 * time.Millisecond, time.Millisecond, 100 * time.Millisecond} {
+		gen, _ := b.allow(now)
+		b.done(gen, nil, cost, now)
+	}
+	if b.state != breakerOpen {
+		t.Fatalf("expect open by slow calls, got %v", b.state)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	policy := &CircuitBreakerPolicy{Window: time.Second, MinRequests: 4}
+	b := newCircuitBreaker("test", policy)
+	now := time.Now()
+	call := func(err error) {
+		gen, _ := b.allow(now)
+		b.done(gen, err, 0, now)
+	}
+	call(errUnavailable)
+	call(errUnavailable)
+	call(errUnavailable)
+	//窗口外的失败不再统计
+	now = now.Add(2 * time.Second)
+	call(errUnavailable)
+	call(nil)
+	call(nil)
+	call(nil)
+	if b.state != breakerClosed {
+		t.Fatalf("expect old failures expired, got %v", b.state)
+	}
+	call(errUnavailable)
+	call(errUnavailable)
+	if b.state != breakerOpen {
+		t.Fatalf("expect open at 50%% in window, got %v", b.state)
+	}
+}
+
+func TestCircuitBreakerPerMethod(t *testing.T) {
+	addr := startTestServer(t)
+	opt := testOption()
+	opt.CircuitBreaker = &CircuitBreakerPolicy{
+		Methods: map[string]*CircuitBreakerPolicy{"Sleeper.Slow": {MinRequests: 1}},
+	}
+	c := newTestXClient(t, opt, addr)
+	key := c.Instances()[0].Key()
+	shared := c.breaker(key, "Sleeper", "Sleep")
+	if shared == nil || shared != c.breaker(key, "Sleeper", "Other") {
+		t.Fatal("expect methods share the server breaker")
+	}
+	if b := c.breaker(key, "Sleeper", "Slow"); b == shared || b.policy.MinRequests != 1 {
+		t.Fatal("expect overridden method uses its own breaker")
+	}
+	opt.CircuitBreaker.PerMethod = true
+	if c.breaker(key, "Sleeper", "Sleep") == c.breaker(key, "Sleeper", "Other") {
+		t.Fatal("expect a breaker per method")
+	}
+}
+
+func TestCircuitBreakerSkipsOpenServer(t *testing.T) {
+	addr1 := startTestServer(t)
+	addr2 := freeAddr(t)
+	s2 := serveOn(t, addr2)
+	opt := testOption()
+	opt.FailMode = Failfast
+	opt.CircuitBreaker = &CircuitBreakerPolicy{MinRequests: 2, OpenTimeout: 50 * time.Millisecond, HalfOpenRequests: 1}
+	c := newTestXClient(t, opt, addr1, addr2)
+
+	call := func() error {
+		var reply int64
+		return c.Call(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	}
+	_ = s2.Close()
+	failed := 0
+	for i := 0; i < 10; i++ {
+		if call() != nil {
+			failed++
+		}
+	}
+	//addr2 失败 2 次后熔断,之后只选择 addr1
+	if failed != 2 {
+		t.Fatalf("expect 2 failures before breaker opens, got %d", failed)
+	}
+
+	serveOn(t, addr2)
+	time.Sleep(60 * time.Millisecond)
+	b := c.breaker("tcp@"+addr2, "Sleeper", "Sleep")
+	waitFor(t, func() bool {
+		_ = call()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state == breakerClosed
+	})
+	for i := 0; i < 10; i++ {
+		if err := call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCircuitBreakerAllOpen(t *testing.T) {
+	addr := freeAddr(t)
+	s := serveOn(t, addr)
+	opt := testOption()
+	opt.FailMode = Failfast
+	opt.CircuitBreaker = &CircuitBreakerPolicy{MinRequests: 1, OpenTimeout: time.Minute}
+	c := newTestXClient(t, opt, addr)
+	_ = s.Close()
+	var reply int64
+	if err := c.Call(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err == nil {
+		t.Fatal("expect call failed")
+	}
+	err := c.Call(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	if errors.CodeOf(err) != errors.Unavailable || !isNotSent(err) {
+		t.Fatalf("expect unavailable before sending, got %v", err)
+	}
+}
+
+func TestCircuitBreakerConsistentHash(t *testing.T) {
+	addr1 := startTestServer(t)
+	for _, mode := range []FailMode{Failfast, Failover} {
+		addr2 := freeAddr(t)
+		s2 := serveOn(t, addr2)
+		opt := testOption()
+		opt.FailMode = mode
+		opt.LoadBalance = lb.ConsistentHash
+		opt.CircuitBreaker = &CircuitBreakerPolicy{MinRequests: 1, OpenTimeout: time.Minute}
+		c := newTestXClient(t, opt, addr1, addr2)
+		ring := c.balancer("Sleeper").(*lb.ConsistentHashLoadBalancer)
+		var ctx context.Context
+		for i := 0; ctx == nil && i < 1000; i++ {
+			if addr, _ := ring.Select("key-" + strconv.Itoa(i)); addr == "tcp@"+addr2 {
+				ctx = lb.WithHashKey(context.Background(), "key-"+strconv.Itoa(i))
+			}
+		}
+		if ctx == nil {
+			t.Fatal("no key routed to " + addr2)
+		}
+		_ = s2.Close()
+		var reply int64
+		_ = c.Call(ctx, "Sleeper", "Sleep", int64(0), &reply)
+		//key 对应的服务端熔断后选择哈希环上的下一个服务端
+		for i := 0; i < 5; i++ {
+			if err := c.Call(ctx, "Sleeper", "Sleep", int64(0), &reply); err != nil {
+				t.Fatalf("%v: expect next server on the ring, got %v", mode, err)
+			}
+		}
+	}
+}
+
+func TestCircuitBreakerAsyncCall(t *testing.T) {
+	addr := freeAddr(t)
+	s := serveOn(t, addr)
+	opt := testOption()
+	opt.FailMode = Failfast
+	opt.CircuitBreaker = &CircuitBreakerPolicy{MinRequests: 1, OpenTimeout: time.Minute}
+	c := newTestXClient(t, opt, addr)
+	_ = s.Close()
+	//异步调用与 Call 一样计入熔断统计
+	if caller := <-c.AsyncCall(context.Background(), "Sleeper", "Sleep", int64(0), new(int64)).Done; caller.Error == nil {
+		t.Fatal("expect call failed")
+	}
+	b := c.breaker("tcp@"+addr, "Sleeper", "Sleep")
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	if state != breakerOpen {
+		t.Fatalf("expect breaker open after async failure, got %v", state)
+	}
+	caller := <-c.AsyncCall(context.Background(), "Sleeper", "Sleep", int64(0), new(int64)).Done
+	if errors.CodeOf(caller.Error) != errors.Unavailable || !isNotSent(caller.Error) {
+		t.Fatalf("expect breaker open before sending, got %v", caller.Error)
+	}
+}
@@ -3,26 +3,44 @@ package client
 import (
 	"bufio"
 	"context"
+	stderrors "errors"
 	"fmt"
 	"github.com/arch3754/mrpc/codec"
+	"github.com/arch3754/mrpc/errors"
 	"github.com/arch3754/mrpc/lb"
 	"github.com/arch3754/mrpc/log"
 	"github.com/arch3754/mrpc/protocol"
+	"github.com/arch3754/mrpc/registry"
 	"github.com/arch3754/mrpc/util"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type client struct {
 	Option        *Option
+	network       string
+	addr          string
 	conn          net.Conn
 	seq           uint64
 	mu            sync.Mutex
 	callerMap     map[uint64]*Caller
-	isClose       bool
+	streamMap     map[uint64]*clientStream
+	closed        int32
+	shutdown      chan struct{}
+	stateMu       sync.Mutex
+	state         ConnState
+	stateCh       chan struct{}
 	serverCpuIdle float64
+	//onCpuIdle 心跳收到服务端空闲 CPU 时回调
+	onCpuIdle func(idle float64)
+	//onHeartbeat 定时心跳结束时回调结果,成功时 err 为 nil
+	onHeartbeat func(err error)
+	//gen 当前连接的代数,live 为 false 表示当前连接已断开,由 mu 保护
+	gen  uint64
+	live bool
 }
 type Caller struct {
 	Path             string
@@ -34,9 +52,22 @@ type Caller struct {
 	Error            error
 	Done             chan *Caller
 	seq              uint64
+	//gen 发出请求的连接的代数
+	gen uint64
 }
 type Option struct {
-	//Retry              int
+	//Retry 重试策略,为 nil 时不重试
+	Retry *RetryPolicy
+	//Hedge Failover 模式下的对冲策略,为 nil 时不对冲
+	Hedge *HedgePolicy
+	//InstanceFilter 路由规则,返回 false 的服务端实例不会被选择,如按 Zone、Version 或 Tags 过滤
+	InstanceFilter func(inst *registry.Instance) bool
+	//HealthCheck 异常检测策略,为 nil 时不摘除服务端
+	HealthCheck *HealthCheckPolicy
+	//CircuitBreaker 熔断策略,为 nil 时不熔断
+	CircuitBreaker *CircuitBreakerPolicy
+	//FailMode XClient.Call 失败处理方式,默认 Failover
+	FailMode           FailMode
 	Serialize          protocol.Serialize
 	ConnTimeout        time.Duration
 	ConnectTimeout     time.Duration
@@ -46,7 +77,20 @@ type Option struct {
 	HbsTimeout         time.Duration
 	Compress           protocol.Compress
 	TCPKeepAlivePeriod time.Duration
-	Breaker            Breaker
+	//Deprecated: 使用 CircuitBreaker
+	Breaker Breaker
+	//PoolSize 每个服务端的连接数,按在途请求数最少选择,按需建连,默认 1
+	PoolSize int
+	//PoolIdleTimeout 连接空闲超过该时间后关闭,下次使用时重新建连,0 表示不回收
+	PoolIdleTimeout time.Duration
+	//ReconnectEnable 连接断开后按指数退避自动重连,关闭时断开即 Shutdown
+	ReconnectEnable    bool
+	ReconnectBaseDelay time.Duration
+	ReconnectMaxDelay  time.Duration
+	//WaitForReady 连接未就绪时调用排队等待重连直到 ctx 结束,否则立即返回 Unavailable
+	WaitForReady bool
+	//Interceptors 客户端拦截器,按顺序由外到内执行,心跳请求不经过拦截器
+	Interceptors []UnaryClientInterceptor
 }
 
 var DefaultOption = &Option{
@@ -59,7 +103,10 @@ var DefaultOption = &Option{
 	HbsTimeout:         15 * time.Second,
 	Compress:           protocol.Gzip,
 	TCPKeepAlivePeriod: time.Second * 60,
-	Breaker:            DefaultBreaker,
+	PoolSize:           1,
+	ReconnectEnable:    true,
+	ReconnectBaseDelay: DefaultReconnectBaseDelay,
+	ReconnectMaxDelay:  DefaultReconnectMaxDelay,
 }
 
 func NewClient(option *Option) *client {
@@ -70,40 +117,96 @@ func NewClient(option *Option) *client {
 		Option:    option,
 		mu:        sync.Mutex{},
 		callerMap: make(map[uint64]*Caller),
+		shutdown:  make(chan struct{}),
+		stateCh:   make(chan struct{}),
 	}
 }
+
+// Connect 建立连接,首次连接失败直接返回错误,之后断开按 Option.ReconnectEnable 自动重连
 func (c *client) Connect(network string, addr string) error {
-	conn, err := c.newTCPConn(network, addr)
+	c.network, c.addr = network, addr
+	c.setState(Connecting)
+	conn, err := c.dial()
 	if err != nil {
 		log.Rlog.Error("%v", err)
+		c.setState(TransientFailure)
 		return err
 	}
+	c.serve(conn)
+	if c.Option.HbsEnable {
+		go c.heartbeatTicker()
+	}
+	return nil
+}
+func (c *client) dial() (net.Conn, error) {
+	conn, err := c.newTCPConn(c.network, c.addr)
+	if err != nil {
+		return nil, err
+	}
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		_ = tcpConn.SetKeepAlivePeriod(c.Option.TCPKeepAlivePeriod)
 		_ = tcpConn.SetKeepAlive(true)
 	}
 	_ = conn.SetDeadline(time.Now().Add(c.Option.ConnTimeout))
+	return conn, nil
+}
+
+// serve 启用新连接并开始读取响应
+func (c *client) serve(conn net.Conn) {
+	c.mu.Lock()
 	c.conn = conn
-	go c.read()
-	if c.Option.HbsEnable {
-		go c.heartbeatTicker()
+	c.gen++
+	c.live = true
+	gen := c.gen
+	c.mu.Unlock()
+	if c.isClosed() {
+		_ = conn.Close()
+		return
 	}
-	return nil
+	c.setState(Ready)
+	go c.read(conn, gen)
+}
+func (c *client) getConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// inFlight 已发出尚未收到响应的请求数
+func (c *client) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.callerMap)
 }
 func (c *client) GetCpuIdle() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.serverCpuIdle
 }
 func (c *client) GetRemoteAddr() string {
-	return c.conn.RemoteAddr().String()
+	return c.getConn().RemoteAddr().String()
 }
 func (c *client) Close() error {
-	c.isClose = true
-	return c.conn.Close()
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.shutdown)
+	c.setState(Shutdown)
+	if conn := c.getConn(); conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+func (c *client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
 }
 func (c *client) newTCPConn(network, address string) (net.Conn, error) {
 	return net.DialTimeout(network, address, c.Option.ConnectTimeout)
 }
 func (c *client) AsyncCall(ctx context.Context, path, method string, arg, reply interface{}) *Caller {
+	if len(c.Option.Interceptors) > 0 {
+		return c.asyncIntercept(ctx, path, method, arg, reply)
+	}
 	caller := &Caller{
 		Path:   path,
 		Method: method,
@@ -112,18 +215,7 @@ func (c *client) AsyncCall(ctx context.Context, path, method string, arg, reply
 		Done:   make(chan *Caller, 1),
 	}
 
-	meta := ctx.Value(util.RequestMetaData)
-	if meta != nil {
-		caller.RequestMetadata = meta.(map[string]string)
-	} else {
-		caller.RequestMetadata = make(map[string]string)
-	}
-	if deadline, ok := ctx.Deadline(); ok {
-		if len(caller.RequestMetadata) == 0 {
-			caller.RequestMetadata = make(map[string]string)
-		}
-		caller.RequestMetadata[util.ServerTimeout] = fmt.Sprintf("%v", time.Until(deadline).Milliseconds())
-	}
+	caller.RequestMetadata = requestMetadata(ctx)
 	if _, ok := ctx.(*util.Context); !ok {
 		ctx = util.NewContext(ctx)
 	}
@@ -132,6 +224,15 @@ func (c *client) AsyncCall(ctx context.Context, path, method string, arg, reply
 }
 
 func (c *client) SyncCall(ctx context.Context, path, method string, arg, reply interface{}) error {
+	uctx, ok := ctx.(*util.Context)
+	if !ok {
+		uctx = util.NewContext(ctx)
+	}
+	return chainUnaryInvoker(c.Option.Interceptors, c.invoke)(uctx, path, method, arg, reply)
+}
+
+// asyncIntercept 在独立的 goroutine 中执行拦截器链,完成后通知 Caller.Done
+func (c *client) asyncIntercept(ctx context.Context, path, method string, arg, reply interface{}) *Caller {
 	caller := &Caller{
 		Path:   path,
 		Method: method,
@@ -139,18 +240,43 @@ func (c *client) SyncCall(ctx context.Context, path, method string, arg, reply i
 		Reply:  reply,
 		Done:   make(chan *Caller, 1),
 	}
-	meta := ctx.Value(util.RequestMetaData)
-	if meta != nil {
-		caller.RequestMetadata = meta.(map[string]string)
-	} else {
-		caller.RequestMetadata = make(map[string]string)
+	caller.RequestMetadata, _ = ctx.Value(util.RequestMetaData).(map[string]string)
+	uctx, ok := ctx.(*util.Context)
+	if !ok {
+		uctx = util.NewContext(ctx)
+	}
+	go func() {
+		caller.Error = chainUnaryInvoker(c.Option.Interceptors, c.invoke)(uctx, path, method, arg, reply)
+		caller.ResponseMetadata, _ = uctx.Value(util.ResponseMetaData).(map[string]string)
+		caller.Done <- caller
+	}()
+	return caller
+}
+
+// requestMetadata 复制 ctx 中的请求元数据并写入服务端超时,
+// 同一个 ctx 的元数据可能被 Broadcast、Forking 与对冲的多个调用并发使用,不能直接修改
+func requestMetadata(ctx context.Context) map[string]string {
+	src, _ := ctx.Value(util.RequestMetaData).(map[string]string)
+	meta := make(map[string]string, len(src)+1)
+	for k, v := range src {
+		meta[k] = v
 	}
 	if deadline, ok := ctx.Deadline(); ok {
-		caller.RequestMetadata[util.ServerTimeout] = fmt.Sprintf("%v", time.Until(deadline).Milliseconds())
+		meta[util.ServerTimeout] = fmt.Sprintf("%v", time.Until(deadline).Milliseconds())
 	}
-	if _, ok := ctx.(*util.Context); !ok {
-		ctx = util.NewContext(ctx)
+	return meta
+}
+
+// invoke 发送请求并等待响应,响应元数据写入 ctx 的 util.ResponseMetaData
+func (c *client) invoke(ctx *util.Context, path, method string, arg, reply interface{}) error {
+	caller := &Caller{
+		Path:   path,
+		Method: method,
+		Arg:    arg,
+		Reply:  reply,
+		Done:   make(chan *Caller, 1),
 	}
+	caller.RequestMetadata = requestMetadata(ctx)
 	c.call(ctx, caller)
 	var err error
 	select {
@@ -158,11 +284,10 @@ func (c *client) SyncCall(ctx context.Context, path, method string, arg, reply i
 		c.mu.Lock()
 		delete(c.callerMap, caller.seq)
 		c.mu.Unlock()
-		caller.Error = ctx.Err()
-		caller.Done <- caller
-
+		err = errors.FromError(ctx.Err())
 	case call := <-caller.Done:
 		err = call.Error
+		ctx.SetValue(util.ResponseMetaData, call.ResponseMetadata)
 	}
 	return err
 }
@@ -175,31 +300,31 @@ func (c *client) heartbeatTicker() {
 	}
 	ticker := time.NewTicker(c.Option.HbsInterval)
 	for range ticker.C {
-		if c.isClose {
+		if c.isClosed() {
 			ticker.Stop()
 			break
 		}
+		if c.GetState() != Ready {
+			continue
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), c.Option.HbsTimeout)
 		var reply int64
-		c.heartbeat(ctx, &reply)
+		err := c.heartbeat(ctx, &reply)
 		cancel()
+		if c.onHeartbeat != nil {
+			c.onHeartbeat(err)
+		}
 	}
 }
-func (c *client) heartbeat(ctx context.Context, reply interface{}) {
+
+// heartbeat 发送一次心跳,失败时断开连接
+func (c *client) heartbeat(ctx context.Context, reply interface{}) error {
 	caller := &Caller{
 		Arg:   time.Now().UnixNano(),
 		Reply: reply,
 		Done:  make(chan *Caller, 1),
 	}
-	meta := ctx.Value(util.RequestMetaData)
-	if meta != nil {
-		caller.RequestMetadata = meta.(map[string]string)
-	} else {
-		caller.RequestMetadata = make(map[string]string)
-	}
-	if deadline, ok := ctx.Deadline(); ok {
-		caller.RequestMetadata[util.ServerTimeout] = fmt.Sprintf("%v", time.Until(deadline).Milliseconds())
-	}
+	caller.RequestMetadata = requestMetadata(ctx)
 	if _, ok := ctx.(*util.Context); !ok {
 		ctx = util.NewContext(ctx)
 	}
@@ -211,30 +336,64 @@ func (c *client) heartbeat(ctx context.Context, reply interface{}) {
 		c.mu.Unlock()
 		caller.Error = ctx.Err()
 		caller.Done <- caller
-		c.Close()
+		c.breakConn()
+		return errors.FromError(ctx.Err())
 	case call := <-caller.Done:
 		if call.Error != nil {
-			log.Rlog.Warn("heartbeat %v err:%v", c.conn.RemoteAddr().String(), call.Error)
-			c.Close()
+			log.Rlog.Warn("heartbeat %v err:%v", c.addr, call.Error)
+			c.breakConn()
+			return call.Error
 		}
-		if v, ok := call.ResponseMetadata["cpu.idle"]; ok {
-			c.serverCpuIdle, _ = strconv.ParseFloat(v, 64)
-			log.Rlog.Debug("heartbeat remoteAddr=%v cpu.idle=%v", c.conn.RemoteAddr().String(), c.serverCpuIdle)
+		if v, ok := call.ResponseMetadata[util.CpuIdle]; ok {
+			idle, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				log.Rlog.Warn("heartbeat %v invalid cpu idle %q:%v", c.addr, v, err)
+				return nil
+			}
+			c.mu.Lock()
+			c.serverCpuIdle = idle
+			c.mu.Unlock()
+			log.Rlog.Debug("heartbeat remoteAddr=%v cpu.idle=%v", c.addr, idle)
+			if c.onCpuIdle != nil {
+				c.onCpuIdle(idle)
+			}
 		}
 	}
+	return nil
+}
+
+// breakConn 关闭当前连接,由读协程决定重连或关闭客户端
+func (c *client) breakConn() {
+	if conn := c.getConn(); conn != nil {
+		_ = conn.Close()
+	}
 }
 func (c *client) call(ctx context.Context, caller *Caller) {
-	_ = c.conn.SetDeadline(time.Now().Add(c.Option.ConnTimeout))
+	if err := c.waitForReady(ctx); err != nil {
+		caller.Error = notSent(errors.CodeOf(err), err)
+		caller.Done <- caller
+		return
+	}
+	//在 mu 内确认连接仍然有效后登记,读协程退出时会完成所有登记在该连接上的调用
 	c.mu.Lock()
+	if !c.live {
+		c.mu.Unlock()
+		caller.Error = notSent(errors.Unavailable, stderrors.New("mrpc: connection is closing"))
+		caller.Done <- caller
+		return
+	}
+	conn := c.conn
 	cdc := codec.CodecMap[c.Option.Serialize]
 	seq := c.seq
 	c.seq++
-
+	caller.seq, caller.gen = seq, c.gen
 	c.callerMap[seq] = caller
 	c.mu.Unlock()
-	caller.seq = seq
+	_ = conn.SetDeadline(time.Now().Add(c.Option.ConnTimeout))
 	req := protocol.GetMsg()
 	req.SetMessageType(protocol.Request)
+	//消息来自对象池,需重置状态,避免沿用上一条错误响应的 Error 状态
+	req.SetStatus(protocol.Normal)
 	req.SetSeq(seq)
 	req.SetHbs(len(caller.Path) == 0 || len(caller.Method) == 0)
 	req.Path = caller.Path
@@ -247,56 +406,97 @@ func (c *client) call(ctx context.Context, caller *Caller) {
 		c.mu.Lock()
 		delete(c.callerMap, seq)
 		c.mu.Unlock()
-		caller.Error = err
+		caller.Error = errors.Wrap(errors.InvalidArgument, err)
 		caller.Done <- caller
 		return
 	}
 	req.Payload = data
-	_, err = c.conn.Write(*req.Encode())
+	_, err = conn.Write(*req.Encode())
 	if err != nil {
 		c.mu.Lock()
 		delete(c.callerMap, seq)
 		c.mu.Unlock()
-		caller.Error = err
+		caller.Error = notSent(errors.Unavailable, err)
 		caller.Done <- caller
 		return
 	}
 }
-func (c *client) read() {
-	r := bufio.NewReader(c.conn)
+
+// read 读取 conn 上的响应,conn 断开后完成该连接上的所有调用并按配置重连
+func (c *client) read(conn net.Conn, gen uint64) {
+	r := bufio.NewReader(conn)
 	var err error
 
 	for {
-		_ = c.conn.SetDeadline(time.Now().Add(c.Option.ConnTimeout))
+		_ = conn.SetDeadline(time.Now().Add(c.Option.ConnTimeout))
 		var resp = protocol.GetMsg()
 		resp.SetMessageType(protocol.Response)
-		if err = resp.Decode(r); err != nil {
+		//压缩方式不支持时帧已完整读取,只让对应的调用失败
+		decodeErr := resp.Decode(r)
+		if decodeErr != nil && !stderrors.Is(decodeErr, protocol.ErrUnsupportedCompress) {
+			err = decodeErr
 			break
 		}
+		if resp.MessageType().IsStream() {
+			c.handleStreamMessage(resp, decodeErr)
+			continue
+		}
 		c.mu.Lock()
 		caller := c.callerMap[resp.Seq()]
 		delete(c.callerMap, resp.Seq())
 		c.mu.Unlock()
+		if caller == nil {
+			//调用方已超时放弃,丢弃迟到的响应
+			continue
+		}
 		caller.ResponseMetadata = resp.Metadata
 		if resp.Status() == protocol.Error {
-			caller.Error = fmt.Errorf("%v", resp.Metadata[util.ResponseError])
+			caller.Error = errors.FromMetadata(resp.Metadata)
+			caller.Done <- caller
+		} else if decodeErr != nil {
+			caller.Error = errors.Wrap(errors.InvalidArgument, decodeErr)
 			caller.Done <- caller
 		} else {
-			cdc := codec.CodecMap[resp.Serialize()]
-			err = cdc.Decode(resp.Payload, caller.Reply)
-			if err != nil {
-				caller.Error = err
+			cdc, ok := codec.CodecMap[resp.Serialize()]
+			if !ok {
+				caller.Error = errors.Errorf(errors.InvalidArgument, "mrpc: unsupported serialize type: %d", resp.Serialize())
+			} else if err = cdc.Decode(resp.Payload, caller.Reply); err != nil {
+				caller.Error = errors.Wrap(errors.Internal, err)
 			}
 			caller.Done <- caller
 		}
-		if c.isClose {
+		if c.isClosed() {
 			break
 		}
 	}
-	c.Close()
-	for _, call := range c.callerMap {
-		call.Error = fmt.Errorf("connection is closing")
+	_ = conn.Close()
+	//先切换状态并标记连接失效,再完成已登记的调用,之后的调用不会再使用该连接
+	if !c.isClosed() {
+		if c.Option.ReconnectEnable {
+			log.Rlog.Warn("connection %v lost:%v, reconnecting", c.addr, err)
+			c.setState(TransientFailure)
+		} else {
+			_ = c.Close()
+		}
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.live = false
+	}
+	var callers []*Caller
+	for seq, call := range c.callerMap {
+		if call.gen == gen {
+			delete(c.callerMap, seq)
+			callers = append(callers, call)
+		}
+	}
+	c.mu.Unlock()
+	for _, call := range callers {
+		call.Error = errors.New(errors.Unavailable, "mrpc: connection is closing")
 		call.Done <- call
 	}
-
-}
\ No newline at end of file
+	c.closeStreams(errors.New(errors.Unavailable, "mrpc: connection is closing"))
+	if !c.isClosed() {
+		go c.reconnect()
+	}
+}
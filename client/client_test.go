@@ -2,8 +2,10 @@ package client
 
 import (
 	"context"
+	"errors"
 	"github.com/arch3754/mrpc/protocol"
 	"github.com/arch3754/mrpc/util"
+	"strings"
 	"testing"
 	"time"
 )
@@ -71,3 +73,39 @@ func TestHeartbeatClient(t *testing.T) {
 
 	time.Sleep(time.Minute)
 }
+
+func TestChainUnaryClient(t *testing.T) {
+	var order []string
+	record := func(name string) UnaryClientInterceptor {
+		return func(ctx *util.Context, path, method string, arg, reply interface{}, invoker UnaryInvoker) error {
+			order = append(order, name+".before")
+			err := invoker(ctx, path, method, arg, reply)
+			order = append(order, name+".after")
+			return err
+		}
+	}
+	invoker := func(ctx *util.Context, path, method string, arg, reply interface{}) error {
+		order = append(order, "invoke")
+		*(reply.(*int64)) = *(arg.(*int64)) + 1
+		return nil
+	}
+	var arg, reply int64 = 1, 0
+	chain := ChainUnaryClient(record("a"), record("b"))
+	if err := chain(util.NewContext(context.Background()), "A", "Add", &arg, &reply, invoker); err != nil {
+		t.Fatal(err)
+	}
+	expect := "a.before,b.before,invoke,b.after,a.after"
+	if got := strings.Join(order, ","); got != expect || reply != 2 {
+		t.Fatalf("expect %v got %v reply=%v", expect, got, reply)
+	}
+
+	deny := errors.New("denied")
+	order = nil
+	reject := func(ctx *util.Context, path, method string, arg, reply interface{}, invoker UnaryInvoker) error {
+		return deny
+	}
+	err := chainUnaryInvoker([]UnaryClientInterceptor{record("a"), reject}, invoker)(util.NewContext(context.Background()), "A", "Add", &arg, &reply)
+	if err != deny || strings.Join(order, ",") != "a.before,a.after" {
+		t.Fatalf("expect rejection, got err=%v order=%v", err, order)
+	}
+}
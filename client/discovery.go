@@ -0,0 +1,273 @@
+package client
+
+import (
+	"github.com/arch3754/mrpc/registry"
+	"sync"
+)
+
+// EventType 服务发现事件类型
+type EventType int
+
+const (
+	// EventAdd 新增注册信息
+	EventAdd EventType = iota
+	// EventUpdate 更新注册信息
+	EventUpdate
+	// EventRemove 删除注册信息,事件中只有 Key
+	EventRemove
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdd:
+		return "Add"
+	case EventUpdate:
+		return "Update"
+	case EventRemove:
+		return "Remove"
+	}
+	return "Invalid"
+}
+
+// Endpoint 服务发现得到的一条注册信息
+type Endpoint struct {
+	//Key 注册信息的唯一标识,删除时使用
+	Key string
+	//Service 提供的服务名,为空时使用 Instance.Services,都为空时视为提供所有服务
+	Service  string
+	Instance *registry.Instance
+}
+
+// services 注册信息提供的服务,"" 表示所有服务
+func (e *Endpoint) services() []string {
+	if e.Service != "" {
+		return []string{e.Service}
+	}
+	if len(e.Instance.Services) > 0 {
+		return e.Instance.Services
+	}
+	return []string{""}
+}
+
+// Event 注册信息的变化
+type Event struct {
+	Type EventType
+	Endpoint
+}
+
+// Discovery 服务发现,XClient 先调用 Watch 再调用 GetServices,
+// 之后按顺序应用 Watch 收到的事件,因此两者之间的变化不会丢失
+type Discovery interface {
+	// GetServices 返回当前所有注册信息
+	GetServices() ([]*Endpoint, error)
+	// Watch 返回注册信息变化的事件,Close 后关闭
+	Watch() <-chan *Event
+	Close() error
+}
+
+// watchers 把事件投递给每个 Watch 返回的 channel,投递不阻塞,
+// 事件先进入队列再按顺序发送,因此持有锁投递事件也不会与 GetServices 死锁
+type watchers struct {
+	mu     sync.Mutex
+	list   []*watcher
+	closed bool
+}
+
+type watcher struct {
+	ch     chan *Event
+	mu     sync.Mutex
+	queue  []*Event
+	closed bool
+	signal chan struct{}
+}
+
+func (w *watchers) watch() <-chan *Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wt := &watcher{ch: make(chan *Event), signal: make(chan struct{}, 1)}
+	if w.closed {
+		close(wt.ch)
+		return wt.ch
+	}
+	w.list = append(w.list, wt)
+	go wt.loop()
+	return wt.ch
+}
+
+func (w *watchers) notify(ev *Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	for _, wt := range w.list {
+		wt.mu.Lock()
+		wt.queue = append(wt.queue, ev)
+		wt.mu.Unlock()
+		wt.wake()
+	}
+}
+
+// close 关闭所有 channel,队列中已有的事件仍会发送
+func (w *watchers) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for _, wt := range w.list {
+		wt.mu.Lock()
+		wt.closed = true
+		wt.mu.Unlock()
+		wt.wake()
+	}
+	w.list = nil
+}
+
+func (wt *watcher) wake() {
+	select {
+	case wt.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (wt *watcher) loop() {
+	defer close(wt.ch)
+	for range wt.signal {
+		wt.mu.Lock()
+		queue, closed := wt.queue, wt.closed
+		wt.queue = nil
+		wt.mu.Unlock()
+		for _, ev := range queue {
+			wt.ch <- ev
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// endpointList 全量获取的注册信息,替换时按 key 与内容比较并投递差异
+type endpointList struct {
+	endpoints []*Endpoint
+	//values key 对应的内容,用于判断是否更新
+	values map[string]string
+}
+
+func (l *endpointList) get() []*Endpoint {
+	return append([]*Endpoint(nil), l.endpoints...)
+}
+
+// replace 替换为新的列表,调用方需保证串行调用
+func (l *endpointList) replace(endpoints []*Endpoint, values map[string]string, w *watchers) {
+	for _, ep := range endpoints {
+		old, ok := l.values[ep.Key]
+		switch {
+		case !ok:
+			w.notify(&Event{Type: EventAdd, Endpoint: *ep})
+		case old != values[ep.Key]:
+			w.notify(&Event{Type: EventUpdate, Endpoint: *ep})
+		}
+	}
+	for _, ep := range l.endpoints {
+		if _, ok := values[ep.Key]; !ok {
+			w.notify(&Event{Type: EventRemove, Endpoint: Endpoint{Key: ep.Key}})
+		}
+	}
+	l.endpoints, l.values = endpoints, values
+}
+
+// StaticDiscovery 固定的服务端列表
+type StaticDiscovery struct {
+	endpoints []*Endpoint
+	watchers  watchers
+}
+
+// NewStaticDiscovery addrs 为 network@addr 或 JSON 格式的注册信息
+func NewStaticDiscovery(addrs ...string) (*StaticDiscovery, error) {
+	d := &StaticDiscovery{}
+	for _, addr := range addrs {
+		inst, err := registry.ParseInstance(addr)
+		if err != nil {
+			return nil, err
+		}
+		d.endpoints = append(d.endpoints, &Endpoint{Key: inst.Key(), Instance: inst})
+	}
+	return d, nil
+}
+
+func (d *StaticDiscovery) GetServices() ([]*Endpoint, error) {
+	return append([]*Endpoint(nil), d.endpoints...), nil
+}
+
+func (d *StaticDiscovery) Watch() <-chan *Event {
+	return d.watchers.watch()
+}
+
+func (d *StaticDiscovery) Close() error {
+	d.watchers.close()
+	return nil
+}
+
+// MemoryDiscovery 由调用方维护注册信息,用于测试或嵌入其他注册中心
+type MemoryDiscovery struct {
+	mu        sync.Mutex
+	endpoints map[string]*Endpoint
+	keys      []string
+	watchers  watchers
+}
+
+func NewMemoryDiscovery() *MemoryDiscovery {
+	return &MemoryDiscovery{endpoints: make(map[string]*Endpoint)}
+}
+
+// Set 新增或更新注册信息,持有锁投递事件以保证事件与注册信息的顺序一致
+func (d *MemoryDiscovery) Set(ep *Endpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	typ := EventUpdate
+	if _, ok := d.endpoints[ep.Key]; !ok {
+		typ = EventAdd
+		d.keys = append(d.keys, ep.Key)
+	}
+	d.endpoints[ep.Key] = ep
+	d.watchers.notify(&Event{Type: typ, Endpoint: *ep})
+}
+
+// Delete 删除注册信息
+func (d *MemoryDiscovery) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.endpoints[key]; !ok {
+		return
+	}
+	delete(d.endpoints, key)
+	keys := make([]string, 0, len(d.keys))
+	for _, k := range d.keys {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	d.keys = keys
+	d.watchers.notify(&Event{Type: EventRemove, Endpoint: Endpoint{Key: key}})
+}
+
+func (d *MemoryDiscovery) GetServices() ([]*Endpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]*Endpoint, 0, len(d.keys))
+	for _, k := range d.keys {
+		list = append(list, d.endpoints[k])
+	}
+	return list, nil
+}
+
+func (d *MemoryDiscovery) Watch() <-chan *Event {
+	return d.watchers.watch()
+}
+
+func (d *MemoryDiscovery) Close() error {
+	d.watchers.close()
+	return nil
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/registry"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.etcd.io/etcd/clientv3"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor 等待 cond 成立
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func recvEvent(t *testing.T, ch <-chan *Event) *Event {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return nil
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	if _, err := NewStaticDiscovery("127.0.0.1:80"); err == nil {
+		t.Fatal("expect error for address without network")
+	}
+	d, err := NewStaticDiscovery("tcp@127.0.0.1:80", `{"network":"tcp","addr":"127.0.0.1:81","weight":3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ := d.GetServices()
+	if len(list) != 2 || list[0].Key != "tcp@127.0.0.1:80" || list[1].Instance.Weight != 3 {
+		t.Fatalf("unexpected endpoints %+v", list)
+	}
+	ch := d.Watch()
+	_ = d.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("watch channel should be closed")
+	}
+}
+
+func TestMemoryDiscoveryXClient(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	d2, addr2 := startDelayedServer(t, 0)
+	d := NewMemoryDiscovery()
+	d.Set(&Endpoint{Key: "a", Instance: &registry.Instance{Network: "tcp", Addr: addr1}})
+	c, err := NewXClient(d, testOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var reply int64
+	if err = c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil || d1.Calls() != 1 {
+		t.Fatalf("expect call on initial endpoint, err %v", err)
+	}
+
+	//事件投递不阻塞,大量变化不需要等待消费
+	for i := 0; i < 100; i++ {
+		d.Set(&Endpoint{Key: "b", Instance: &registry.Instance{Network: "tcp", Addr: addr2, Version: "v1"}})
+	}
+	d.Delete("a")
+	waitFor(t, func() bool {
+		insts := c.Instances()
+		return len(insts) == 1 && insts[0].Addr == addr2
+	})
+	if err = c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil || d2.Calls() != 1 {
+		t.Fatalf("expect call on watched endpoint, err %v", err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Instances()) != 0 {
+		t.Fatal("expect no instances after close")
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# servers\ntcp@127.0.0.1:80\n\ntcp@127.0.0.1:81\n")
+	d, err := NewFileDiscovery(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ch := d.Watch()
+	list, _ := d.GetServices()
+	if len(list) != 2 {
+		t.Fatalf("unexpected endpoints %+v", list)
+	}
+
+	write(`tcp@127.0.0.1:80
+{"network":"tcp","addr":"127.0.0.1:81","version":"v2"}
+tcp@127.0.0.1:82
+`)
+	if ev := recvEvent(t, ch); ev.Type != EventUpdate || ev.Instance.Version != "v2" {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+	if ev := recvEvent(t, ch); ev.Type != EventAdd || ev.Key != "tcp@127.0.0.1:82" {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+
+	//内容有误时保留原列表
+	write("tcp@127.0.0.1:80\nbad line\n")
+	time.Sleep(50 * time.Millisecond)
+	if list, _ = d.GetServices(); len(list) != 3 {
+		t.Fatalf("expect last good list kept, got %+v", list)
+	}
+
+	write("tcp@127.0.0.1:82\n")
+	for _, key := range []string{"tcp@127.0.0.1:80", "tcp@127.0.0.1:81"} {
+		if ev := recvEvent(t, ch); ev.Type != EventRemove || ev.Key != key {
+			t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+		}
+	}
+}
+
+func TestEtcdDiscoveryEndpoint(t *testing.T) {
+	d := &EtcdDiscovery{prefix: "/mrpc"}
+	ep, ok := d.endpoint("/mrpc/Arith/tcp@127.0.0.1:80", `{"network":"tcp","addr":"127.0.0.1:80","services":["Arith","Echo"]}`)
+	if !ok || ep.Service != "Arith" || ep.Instance.Addr != "127.0.0.1:80" {
+		t.Fatalf("unexpected endpoint %+v", ep)
+	}
+	//旧格式的 key 不含服务名
+	ep, ok = d.endpoint("/mrpc/tcp@127.0.0.1:80", "tcp@127.0.0.1:80")
+	if !ok || ep.Service != "" || ep.Key != "/mrpc/tcp@127.0.0.1:80" {
+		t.Fatalf("unexpected endpoint %+v", ep)
+	}
+	if _, ok = d.endpoint("/mrpc/bad", "bad"); ok {
+		t.Fatal("expect invalid value skipped")
+	}
+}
+
+func TestEtcdDiscoveryResync(t *testing.T) {
+	d := &EtcdDiscovery{
+		prefix:    "/mrpc",
+		endpoints: make(map[string]*Endpoint),
+		values:    make(map[string]string),
+	}
+	kv := func(key, val string, rev int64) *mvccpb.KeyValue {
+		return &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val), ModRevision: rev}
+	}
+	ch := d.Watch()
+	defer d.watchers.close()
+	d.sync([]*mvccpb.KeyValue{
+		kv("/mrpc/A/tcp@127.0.0.1:80", "tcp@127.0.0.1:80", 3),
+		kv("/mrpc/A/tcp@127.0.0.1:81", "tcp@127.0.0.1:81", 4),
+	}, 10)
+	for i := 0; i < 2; i++ {
+		if ev := recvEvent(t, ch); ev.Type != EventAdd || ev.Service != "A" {
+			t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+		}
+	}
+
+	d.apply([]*clientv3.Event{
+		{Type: mvccpb.PUT, Kv: kv("/mrpc/A/tcp@127.0.0.1:80", `{"network":"tcp","addr":"127.0.0.1:80","version":"v2"}`, 11)},
+		{Type: mvccpb.DELETE, Kv: kv("/mrpc/A/tcp@127.0.0.1:81", "", 12)},
+	})
+	if ev := recvEvent(t, ch); ev.Type != EventUpdate || ev.Instance.Version != "v2" {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+	if ev := recvEvent(t, ch); ev.Type != EventRemove || ev.Key != "/mrpc/A/tcp@127.0.0.1:81" {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+	if d.rev != 12 {
+		t.Fatalf("expect revision 12, got %d", d.rev)
+	}
+
+	//断开期间 80 被删除,82 新增,全量同步后只投递差异
+	d.sync([]*mvccpb.KeyValue{
+		kv("/mrpc/A/tcp@127.0.0.1:82", "tcp@127.0.0.1:82", 15),
+	}, 20)
+	if ev := recvEvent(t, ch); ev.Type != EventAdd || ev.Key != "/mrpc/A/tcp@127.0.0.1:82" {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+	if ev := recvEvent(t, ch); ev.Type != EventRemove || ev.Key != "/mrpc/A/tcp@127.0.0.1:80" {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+	d.sync([]*mvccpb.KeyValue{
+		kv("/mrpc/A/tcp@127.0.0.1:82", "tcp@127.0.0.1:82", 15),
+	}, 21)
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if list, _ := d.GetServices(); len(list) != 1 || d.rev != 21 {
+		t.Fatalf("unexpected state %+v at %d", list, d.rev)
+	}
+}
+
+func TestFileDiscoveryYAML(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	d2, addr2 := startDelayedServer(t, 0)
+	path := filepath.Join(t.TempDir(), "servers.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`servers:
+  - addr: tcp@` + addr1 + `
+    weight: 10
+    tags: [canary]
+`)
+	d, err := NewFileDiscovery(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewXClient(d, testOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	insts := c.Instances()
+	if len(insts) != 1 || insts[0].Weight != 10 || !insts[0].HasTag("canary") {
+		t.Fatalf("unexpected instances %+v", insts)
+	}
+	var reply int64
+	if err = c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil || d1.Calls() != 1 {
+		t.Fatalf("expect call on file endpoint, err %v", err)
+	}
+
+	//校验失败时保留上一次的列表
+	write(`servers:
+  - addr: tcp@` + addr2 + `
+    weight: -1
+`)
+	time.Sleep(50 * time.Millisecond)
+	if insts = c.Instances(); len(insts) != 1 || insts[0].Addr != addr1 {
+		t.Fatalf("expect last good list kept, got %+v", insts)
+	}
+
+	write(`servers:
+  - network: tcp
+    addr: ` + addr2 + `
+    service: Delayed
+`)
+	waitFor(t, func() bool {
+		insts := c.Instances()
+		return len(insts) == 1 && insts[0].Addr == addr2
+	})
+	if err = c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil || d2.Calls() != 1 {
+		t.Fatalf("expect call on reloaded endpoint, err %v", err)
+	}
+}
+
+func TestParseEndpointFileJSON(t *testing.T) {
+	eps, _, err := parseEndpointFile("servers.json", []byte(`{"servers":[
+		{"addr":"tcp@127.0.0.1:80","zone":"sh-a"},
+		{"network":"tcp","addr":"127.0.0.1:80","service":"Arith"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != 2 || eps[0].Key != "tcp@127.0.0.1:80" || eps[0].Instance.Zone != "sh-a" ||
+		eps[1].Key != "Arith/tcp@127.0.0.1:80" || eps[1].Service != "Arith" {
+		t.Fatalf("unexpected endpoints %+v %+v", eps[0], eps[1])
+	}
+	for _, data := range []string{
+		`{"servers":[{"addr":"127.0.0.1:80"}]}`,
+		`{"servers":[{"addr":"tcp@127.0.0.1"}]}`,
+		`{"servers":[{"addr":"tcp@127.0.0.1:80"},{"addr":"tcp@127.0.0.1:80"}]}`,
+		`{"servers":[{"addr":"tcp@127.0.0.1:80","unknown":1}]}`,
+		`{"servers":[`,
+	} {
+		if _, _, err = parseEndpointFile("servers.json", []byte(data)); err == nil {
+			t.Fatalf("expect error for %s", data)
+		}
+	}
+}
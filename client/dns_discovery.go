@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/registry"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDNSDiscoveryInterval 重新解析的默认间隔
+	DefaultDNSDiscoveryInterval = 30 * time.Second
+	// dnsLookupTimeout 单次解析的超时时间
+	dnsLookupTimeout = 5 * time.Second
+)
+
+// Resolver DNS 解析,*net.Resolver 满足该接口,测试时可替换为进程内实现
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery 定期解析域名得到服务端列表,解析失败或没有记录时保留上一次的列表。
+// target 为 host:port 时查询 A/AAAA 记录,为 _service._proto.name 时查询 SRV 记录,
+// 端口与权重取自 SRV,只使用优先级最高(priority 最小)的记录
+type DNSDiscovery struct {
+	target    string
+	host      string
+	port      string
+	srv       bool
+	interval  time.Duration
+	resolver  Resolver
+	mu        sync.Mutex
+	list      endpointList
+	watchers  watchers
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDNSDiscovery resolver 为 nil 时使用 net.DefaultResolver
+func NewDNSDiscovery(target string, interval time.Duration, resolver Resolver) (*DNSDiscovery, error) {
+	if interval <= 0 {
+		interval = DefaultDNSDiscoveryInterval
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	d := &DNSDiscovery{
+		target:   target,
+		interval: interval,
+		resolver: resolver,
+		done:     make(chan struct{}),
+	}
+	if strings.HasPrefix(target, "_") {
+		d.srv = true
+	} else {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		d.host, d.port = host, port
+	}
+	if err := d.resolve(); err != nil {
+		return nil, err
+	}
+	go d.loop()
+	return d, nil
+}
+
+func (d *DNSDiscovery) GetServices() ([]*Endpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.list.get(), nil
+}
+
+func (d *DNSDiscovery) Watch() <-chan *Event {
+	return d.watchers.watch()
+}
+
+func (d *DNSDiscovery) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.watchers.close()
+	})
+	return nil
+}
+
+func (d *DNSDiscovery) loop() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			if err := d.resolve(); err != nil {
+				log.Rlog.Warn("dns discovery %v resolve failed:%v", d.target, err)
+			}
+		}
+	}
+}
+
+// resolve 解析一次并投递与上一次结果的差异
+func (d *DNSDiscovery) resolve() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	var (
+		insts []*registry.Instance
+		err   error
+	)
+	if d.srv {
+		insts, err = d.lookupSRV(ctx)
+	} else {
+		insts, err = d.lookupHost(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return fmt.Errorf("no records for %v", d.target)
+	}
+	endpoints := make([]*Endpoint, 0, len(insts))
+	values := make(map[string]string, len(insts))
+	for _, inst := range insts {
+		key := inst.Key()
+		if _, ok := values[key]; ok {
+			continue
+		}
+		val, err := inst.Marshal()
+		if err != nil {
+			return err
+		}
+		values[key] = val
+		endpoints = append(endpoints, &Endpoint{Key: key, Instance: inst})
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.list.replace(endpoints, values, &d.watchers)
+	return nil
+}
+
+func (d *DNSDiscovery) lookupHost(ctx context.Context) ([]*registry.Instance, error) {
+	addrs, err := d.resolver.LookupHost(ctx, d.host)
+	if err != nil {
+		return nil, err
+	}
+	insts := make([]*registry.Instance, 0, len(addrs))
+	for _, addr := range addrs {
+		insts = append(insts, &registry.Instance{Network: "tcp", Addr: net.JoinHostPort(addr, d.port)})
+	}
+	return insts, nil
+}
+
+func (d *DNSDiscovery) lookupSRV(ctx context.Context) ([]*registry.Instance, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.target)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	top := records[0].Priority
+	for _, r := range records {
+		if r.Priority < top {
+			top = r.Priority
+		}
+	}
+	var insts []*registry.Instance
+	for _, r := range records {
+		if r.Priority != top {
+			continue
+		}
+		insts = append(insts, &registry.Instance{
+			Network: "tcp",
+			Addr:    net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))),
+			Weight:  int(r.Weight),
+		})
+	}
+	return insts, nil
+}
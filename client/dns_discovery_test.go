@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver 进程内的 DNS 记录
+type fakeResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.hosts[host], nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return name, r.srvs[name], nil
+}
+
+func (r *fakeResolver) set(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f()
+}
+
+func TestDNSDiscoveryHost(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	_, port, _ := net.SplitHostPort(addr1)
+	r := &fakeResolver{hosts: map[string][]string{"svc.local": {"127.0.0.1"}}}
+	d, err := NewDNSDiscovery("svc.local:"+port, 10*time.Millisecond, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewXClient(d, testOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var reply int64
+	if err = c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil || d1.Calls() != 1 {
+		t.Fatalf("expect call on resolved endpoint, err %v", err)
+	}
+
+	ch := d.Watch()
+	r.set(func() { r.hosts["svc.local"] = []string{"127.0.0.1", "::1"} })
+	if ev := recvEvent(t, ch); ev.Type != EventAdd || ev.Key != "tcp@[::1]:"+port {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+
+	//解析失败或没有记录时保留上一次的列表
+	r.set(func() { r.err = errors.New("timeout") })
+	time.Sleep(50 * time.Millisecond)
+	r.set(func() { r.err, r.hosts["svc.local"] = nil, nil })
+	time.Sleep(50 * time.Millisecond)
+	if list, _ := d.GetServices(); len(list) != 2 {
+		t.Fatalf("expect last list kept, got %+v", list)
+	}
+
+	r.set(func() { r.hosts["svc.local"] = []string{"::1"} })
+	if ev := recvEvent(t, ch); ev.Type != EventRemove || ev.Key != "tcp@127.0.0.1:"+port {
+		t.Fatalf("unexpected event %v %+v", ev.Type, ev.Endpoint)
+	}
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	r := &fakeResolver{srvs: map[string][]*net.SRV{"_mrpc._tcp.local": {
+		{Target: "a.local.", Port: 8001, Priority: 10, Weight: 5},
+		{Target: "b.local.", Port: 8002, Priority: 10, Weight: 1},
+		{Target: "backup.local.", Port: 8003, Priority: 20, Weight: 1},
+	}}}
+	d, err := NewDNSDiscovery("_mrpc._tcp.local", time.Hour, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	list, _ := d.GetServices()
+	if len(list) != 2 || list[0].Key != "tcp@a.local:8001" || list[0].Instance.Weight != 5 || list[1].Key != "tcp@b.local:8002" {
+		t.Fatalf("unexpected endpoints %+v", list)
+	}
+
+	if _, err = NewDNSDiscovery("_none._tcp.local", time.Hour, r); err == nil {
+		t.Fatal("expect error without records")
+	}
+	if _, err = NewDNSDiscovery("svc.local", time.Hour, r); err == nil {
+		t.Fatal("expect error without port")
+	}
+}
@@ -66,4 +66,4 @@ func TestEtcdClient(t *testing.T) {
 		t.Log("reply:", reply)
 	}
 	cancel()
-}
\ No newline at end of file
+}
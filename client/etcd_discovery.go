@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/registry"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.etcd.io/etcd/clientv3"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdClient 使用 etcd 服务发现的 XClient
+type EtcdClient = XClient
+
+func NewEtcdClient(etcdAddr []string, prefix string, option *Option) (*EtcdClient, error) {
+	d, err := NewEtcdDiscovery(etcdAddr, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return NewXClient(d, option)
+}
+
+// EtcdDiscovery 从 etcd 的 prefix 下获取注册信息,key 格式为 prefix/<service>/<network@addr>。
+// watch 从上次处理的 revision 继续,断开或 revision 被压缩后重新全量同步
+type EtcdDiscovery struct {
+	prefix     string
+	etcdClient *clientv3.Client
+	mu         sync.Mutex
+	endpoints  map[string]*Endpoint
+	values     map[string]string
+	//rev 已处理的 revision
+	rev      int64
+	watchers watchers
+	cancel   context.CancelFunc
+}
+
+func NewEtcdDiscovery(etcdAddr []string, prefix string) (*EtcdDiscovery, error) {
+	etcdClient, err := clientv3.New(clientv3.Config{Endpoints: etcdAddr, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &EtcdDiscovery{
+		prefix:     prefix,
+		etcdClient: etcdClient,
+		endpoints:  make(map[string]*Endpoint),
+		values:     make(map[string]string),
+		cancel:     cancel,
+	}
+	if err = d.resync(ctx); err != nil {
+		cancel()
+		_ = etcdClient.Close()
+		return nil, err
+	}
+	go d.watch(ctx)
+	return d, nil
+}
+
+func (d *EtcdDiscovery) GetServices() ([]*Endpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]string, 0, len(d.endpoints))
+	for key := range d.endpoints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]*Endpoint, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, d.endpoints[key])
+	}
+	return list, nil
+}
+
+func (d *EtcdDiscovery) Watch() <-chan *Event {
+	return d.watchers.watch()
+}
+
+func (d *EtcdDiscovery) Close() error {
+	d.cancel()
+	d.watchers.close()
+	return d.etcdClient.Close()
+}
+
+// endpoint 解析注册信息,旧格式 prefix/<network@addr> 的 key 不含服务名
+func (d *EtcdDiscovery) endpoint(key, val string) (*Endpoint, bool) {
+	inst, err := registry.ParseInstance(val)
+	if err != nil {
+		log.Rlog.Warn("server %v register info invalid:%v", key, err)
+		return nil, false
+	}
+	ep := &Endpoint{Key: key, Instance: inst}
+	rest := strings.TrimPrefix(strings.TrimPrefix(key, d.prefix), "/")
+	if name := "/" + inst.Key(); strings.HasSuffix(rest, name) && len(rest) > len(name) {
+		ep.Service = rest[:len(rest)-len(name)]
+	}
+	return ep, true
+}
+
+// put 记录注册信息并投递事件,内容不变或无法解析时忽略,调用方需持有 d.mu
+func (d *EtcdDiscovery) put(key, val string) {
+	old, ok := d.values[key]
+	if ok && old == val {
+		return
+	}
+	ep, valid := d.endpoint(key, val)
+	if !valid {
+		return
+	}
+	d.endpoints[key], d.values[key] = ep, val
+	typ := EventUpdate
+	if !ok {
+		typ = EventAdd
+	}
+	d.watchers.notify(&Event{Type: typ, Endpoint: *ep})
+}
+
+// del 删除注册信息并投递事件,调用方需持有 d.mu
+func (d *EtcdDiscovery) del(key string) {
+	if _, ok := d.endpoints[key]; !ok {
+		return
+	}
+	delete(d.endpoints, key)
+	delete(d.values, key)
+	d.watchers.notify(&Event{Type: EventRemove, Endpoint: Endpoint{Key: key}})
+}
+
+// resync 全量读取注册信息,与当前记录比较后投递差异
+func (d *EtcdDiscovery) resync(ctx context.Context) error {
+	resp, err := d.etcdClient.Get(ctx, d.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	d.sync(resp.Kvs, resp.Header.Revision)
+	return nil
+}
+
+// sync 以 kvs 为 rev 时的全部注册信息更新当前记录
+func (d *EtcdDiscovery) sync(kvs []*mvccpb.KeyValue, rev int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	exist := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		exist[string(kv.Key)] = true
+		d.put(string(kv.Key), string(kv.Value))
+	}
+	for key := range d.endpoints {
+		if !exist[key] {
+			d.del(key)
+		}
+	}
+	d.rev = rev
+}
+
+// apply 处理 watch 收到的事件
+func (d *EtcdDiscovery) apply(events []*clientv3.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ev := range events {
+		switch ev.Type {
+		case mvccpb.PUT:
+			d.put(string(ev.Kv.Key), string(ev.Kv.Value))
+		case mvccpb.DELETE:
+			d.del(string(ev.Kv.Key))
+		}
+		if ev.Kv.ModRevision > d.rev {
+			d.rev = ev.Kv.ModRevision
+		}
+	}
+}
+
+// watch 从 rev 之后开始监听,watch 中断后按退避全量同步再继续
+func (d *EtcdDiscovery) watch(ctx context.Context) {
+	for attempt := 0; ; {
+		d.mu.Lock()
+		rev := d.rev
+		d.mu.Unlock()
+		//WithRequireLeader 使与集群失联的节点上的 watch 及时中断
+		wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		rch := d.etcdClient.Watch(wctx, d.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for wResp := range rch {
+			if wResp.CompactRevision != 0 {
+				log.Rlog.Warn("etcd watch %v compacted at %v, resync", d.prefix, wResp.CompactRevision)
+				break
+			}
+			if err := wResp.Err(); err != nil {
+				log.Rlog.Warn("etcd watch %v failed:%v, resync", d.prefix, err)
+				break
+			}
+			d.apply(wResp.Events)
+			attempt = 0
+		}
+		cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff(DefaultReconnectBaseDelay, DefaultReconnectMaxDelay, attempt)):
+			}
+			attempt++
+			err := d.resync(ctx)
+			if err == nil {
+				break
+			}
+			log.Rlog.Warn("etcd resync %v failed:%v", d.prefix, err)
+		}
+	}
+}
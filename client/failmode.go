@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/log"
+	"reflect"
+	"sync"
+)
+
+// FailMode 调用失败时的处理方式
+type FailMode int
+
+const (
+	// Failover 失败后按重试策略换一个服务端重试,未配置 Option.Retry 时
+	// 只有请求未发出的调用依次换到尚未尝试过的服务端,不等待
+	Failover FailMode = iota
+	// Failfast 只调用一次,失败直接返回
+	Failfast
+	// Failtry 失败后按重试策略在同一服务端重试
+	Failtry
+	// Broadcast 调用所有服务端,全部成功才算成功
+	Broadcast
+	// Forking 同时调用所有服务端,任意一个成功即返回
+	Forking
+)
+
+func (m FailMode) String() string {
+	switch m {
+	case Failover:
+		return "Failover"
+	case Failfast:
+		return "Failfast"
+	case Failtry:
+		return "Failtry"
+	case Broadcast:
+		return "Broadcast"
+	case Forking:
+		return "Forking"
+	}
+	return "Invalid"
+}
+
+type failModeKey struct{}
+
+// WithFailMode 为单次调用指定 FailMode,覆盖 Option.FailMode
+func WithFailMode(ctx context.Context, mode FailMode) context.Context {
+	return context.WithValue(ctx, failModeKey{}, mode)
+}
+
+func failModeFrom(ctx context.Context, def FailMode) FailMode {
+	if mode, ok := ctx.Value(failModeKey{}).(FailMode); ok {
+		return mode
+	}
+	return def
+}
+
+// callFailover 失败后由负载均衡选择尚未尝试过的服务端重试
+func (c *XClient) callFailover(ctx context.Context, path, method string, arg, reply interface{}) error {
+	policy := c.option.Retry.forMethod(path, method)
+	tried := make(map[string]bool)
+	var err error
+	for attempt := 0; ; attempt++ {
+		key, pool, e := c.pickPool(ctx, path, method, tried)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			return err
+		}
+		if policy == nil && tried[key] {
+			//所有服务端都已尝试过
+			return err
+		}
+		tried[key] = true
+		if err = c.hedgedCall(ctx, key, pool, tried, path, method, arg, reply); err == nil {
+			return nil
+		}
+		if policy == nil {
+			//请求已发出时无法确定服务端是否已执行,不换服务端重发
+			if !isNotSent(err) {
+				return err
+			}
+			log.Rlog.Debug("call %v.%v on %v failed:%v, failover", path, method, key, err)
+			continue
+		}
+		if attempt+1 >= policy.maxAttempts() || !policy.shouldRetry(err) {
+			return err
+		}
+		log.Rlog.Debug("call %v.%v on %v failed:%v, retry %v", path, method, key, err, attempt+1)
+		if !policy.wait(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// callFailtry 失败后在同一服务端重试
+func (c *XClient) callFailtry(ctx context.Context, path, method string, arg, reply interface{}) error {
+	policy := c.option.Retry.forMethod(path, method)
+	key, pool, err := c.pickPool(ctx, path, method, nil)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		if err = c.callPool(ctx, key, pool, path, method, arg, reply); err == nil {
+			return nil
+		}
+		if attempt+1 >= policy.maxAttempts() || !policy.shouldRetry(err) {
+			return err
+		}
+		log.Rlog.Debug("call %v.%v on %v failed:%v, retry %v", path, method, key, err, attempt+1)
+		if !policy.wait(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// callAll 并发调用所有服务端,Broadcast 等待全部完成并返回第一个错误,
+// Forking 在第一个成功时返回,全部失败时返回最后一个错误
+func (c *XClient) callAll(ctx context.Context, mode FailMode, path, method string, arg, reply interface{}) error {
+	keys, pools := c.allPools(path)
+	if len(pools) == 0 {
+		return errors.New(errors.Unavailable, "not available service")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	done := make(chan error, len(pools))
+	for i := range pools {
+		go func(key string, pool *connPool) {
+			r := newReply(reply)
+			err := c.callPool(ctx, key, pool, path, method, arg, r)
+			if err == nil {
+				once.Do(func() { setReply(reply, r) })
+			}
+			done <- err
+		}(keys[i], pools[i])
+	}
+	var firstErr, lastErr error
+	for range pools {
+		err := <-done
+		if err == nil {
+			if mode == Forking {
+				return nil
+			}
+			continue
+		}
+		lastErr = err
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if mode == Forking {
+		return lastErr
+	}
+	return firstErr
+}
+
+// allPools 返回提供 path 且未被摘除的服务端及其连接池
+func (c *XClient) allPools(path string) ([]string, []*connPool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	set := c.service(path)
+	if set == nil {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(set.active))
+	pools := make([]*connPool, 0, len(set.active))
+	for _, key := range set.active {
+		if pool, ok := c.serverConnPool[key]; ok {
+			keys = append(keys, key)
+			pools = append(pools, pool)
+		}
+	}
+	return keys, pools
+}
+
+// newReply 为并发调用创建独立的 reply,避免多个响应同时解码到同一对象
+func newReply(reply interface{}) interface{} {
+	v := reflect.ValueOf(reply)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return reply
+	}
+	return reflect.New(v.Elem().Type()).Interface()
+}
+
+func setReply(reply, r interface{}) {
+	v := reflect.ValueOf(reply)
+	if v.Kind() != reflect.Ptr || v.IsNil() || reply == r {
+		return
+	}
+	v.Elem().Set(reflect.ValueOf(r).Elem())
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/util"
+	"testing"
+	"time"
+)
+
+func TestFailfastIgnoresRetry(t *testing.T) {
+	_, f, addr := startFlakyServer(t, 1)
+	opt := testOption()
+	opt.FailMode = Failfast
+	opt.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Idempotent: true}
+	c := newTestXClient(t, opt, addr)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(1), &reply); err == nil {
+		t.Fatal("expect error")
+	}
+	if n := f.Calls(); n != 1 {
+		t.Fatalf("expect 1 attempt, got %d", n)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	_, bad, badAddr := startFlakyServer(t, 100)
+	_, good, goodAddr := startFlakyServer(t, 0)
+	opt := testOption()
+	opt.Retry = &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, Idempotent: true}
+	c := newTestXClient(t, opt, badAddr, goodAddr)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(5), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 5 {
+		t.Fatalf("expect reply 5, got %d", reply)
+	}
+	if bad.Calls() != 1 || good.Calls() != 1 {
+		t.Fatalf("expect one call on each server, got bad=%d good=%d", bad.Calls(), good.Calls())
+	}
+}
+
+func TestFailoverWithoutRetryPolicy(t *testing.T) {
+	downAddr := freeAddr(t)
+	down := serveOn(t, downAddr)
+	_, good, goodAddr := startFlakyServer(t, 0)
+	opt := *DefaultOption
+	opt.HbsEnable = false
+	c := newTestXClient(t, &opt, downAddr, goodAddr)
+	_ = down.Close()
+	c.lock.RLock()
+	downPool := c.serverConnPool["tcp@"+downAddr]
+	c.lock.RUnlock()
+	waitFor(t, func() bool { return downPool.connCount() == 0 })
+	//未配置重试策略时请求未发出的调用换到未尝试过的服务端
+	for i := 0; i < 3; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Flaky", "Call", int64(5), &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != 5 {
+			t.Fatalf("expect reply 5, got %d", reply)
+		}
+	}
+	if good.Calls() != 3 {
+		t.Fatalf("expect every call to reach the good server, got %d", good.Calls())
+	}
+
+	//已发出的请求失败时不重发到其他服务端
+	_, bad, badAddr := startFlakyServer(t, 100)
+	_, good, goodAddr = startFlakyServer(t, 0)
+	c = newTestXClient(t, &opt, badAddr, goodAddr)
+	failed := 0
+	for i := 0; i < 4; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Flaky", "Call", int64(5), &reply); err != nil {
+			if errors.CodeOf(err) != errors.Unavailable {
+				t.Fatalf("expect unavailable, got %v", err)
+			}
+			failed++
+		}
+	}
+	if failed == 0 || int32(failed) != bad.Calls() || bad.Calls()+good.Calls() != 4 {
+		t.Fatalf("expect no replay after sending, got failed=%d bad=%d good=%d", failed, bad.Calls(), good.Calls())
+	}
+}
+
+func TestFailtry(t *testing.T) {
+	_, f1, addr1 := startFlakyServer(t, 2)
+	_, f2, addr2 := startFlakyServer(t, 2)
+	opt := testOption()
+	opt.FailMode = Failtry
+	opt.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Idempotent: true}
+	c := newTestXClient(t, opt, addr1, addr2)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if n1, n2 := f1.Calls(), f2.Calls(); n1+n2 != 3 || (n1 != 0 && n2 != 0) {
+		t.Fatalf("expect all attempts on one server, got %d and %d", n1, n2)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	var addrs []string
+	var servers []*Flaky
+	for i := 0; i < 3; i++ {
+		_, f, addr := startFlakyServer(t, 0)
+		addrs = append(addrs, addr)
+		servers = append(servers, f)
+	}
+	opt := testOption()
+	opt.FailMode = Broadcast
+	c := newTestXClient(t, opt, addrs...)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(9), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 9 {
+		t.Fatalf("expect reply 9, got %d", reply)
+	}
+	for i, f := range servers {
+		if n := f.Calls(); n != 1 {
+			t.Fatalf("server %d got %d calls, expect 1", i, n)
+		}
+	}
+
+	_, _, badAddr := startFlakyServer(t, 100)
+	c = newTestXClient(t, opt, addrs[0], badAddr)
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(9), &reply); err == nil {
+		t.Fatal("broadcast should fail when any server fails")
+	}
+}
+
+func TestBroadcastRequestMetadata(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 4; i++ {
+		_, _, addr := startFlakyServer(t, 0)
+		addrs = append(addrs, addr)
+	}
+	opt := testOption()
+	opt.FailMode = Broadcast
+	c := newTestXClient(t, opt, addrs...)
+	//并发的调用共用 ctx 中的元数据,不能写入同一个 map
+	meta := map[string]string{"trace": "1"}
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(util.SetRequestMetadata(context.Background(), meta), time.Second)
+		var reply int64
+		err := c.Call(ctx, "Flaky", "Call", int64(9), &reply)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := meta[util.ServerTimeout]; ok || len(meta) != 1 {
+		t.Fatalf("caller metadata modified: %v", meta)
+	}
+}
+
+func TestForking(t *testing.T) {
+	_, _, badAddr := startFlakyServer(t, 100)
+	_, _, goodAddr := startFlakyServer(t, 0)
+	opt := testOption()
+	opt.FailMode = Forking
+	c := newTestXClient(t, opt, badAddr, goodAddr)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(3), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 3 {
+		t.Fatalf("expect reply 3, got %d", reply)
+	}
+
+	c = newTestXClient(t, opt, badAddr)
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(3), &reply); err == nil {
+		t.Fatal("forking should fail when all servers fail")
+	}
+}
+
+func TestFailModeOverride(t *testing.T) {
+	_, f1, addr1 := startFlakyServer(t, 0)
+	_, f2, addr2 := startFlakyServer(t, 0)
+	c := newTestXClient(t, testOption(), addr1, addr2)
+	var reply int64
+	ctx := WithFailMode(context.Background(), Broadcast)
+	if err := c.Call(ctx, "Flaky", "Call", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if f1.Calls() != 1 || f2.Calls() != 1 {
+		t.Fatalf("expect broadcast to both servers, got %d and %d", f1.Calls(), f2.Calls())
+	}
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/registry"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFileDiscoveryInterval 检查文件变化的默认间隔
+const DefaultFileDiscoveryInterval = time.Second
+
+// FileDiscovery 从文件读取注册信息并定期检查文件变化,内容有误时保留上一次的列表。
+// 扩展名为 .yaml/.yml/.json 时按 fileConfig 解析,例如
+//
+//	servers:
+//	  - addr: tcp@127.0.0.1:8972
+//	    weight: 10
+//	    tags: [canary]
+//	  - network: tcp
+//	    addr: 127.0.0.1:8973
+//	    service: Arith
+//
+// 其他文件每行一条 network@addr 或 JSON 格式的注册信息,# 开头的行为注释
+type FileDiscovery struct {
+	path      string
+	interval  time.Duration
+	mu        sync.Mutex
+	list      endpointList
+	modTime   time.Time
+	size      int64
+	watchers  watchers
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = DefaultFileDiscoveryInterval
+	}
+	d := &FileDiscovery{
+		path:     path,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	if err := d.reload(); err != nil {
+		return nil, err
+	}
+	go d.loop()
+	return d, nil
+}
+
+func (d *FileDiscovery) GetServices() ([]*Endpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.list.get(), nil
+}
+
+func (d *FileDiscovery) Watch() <-chan *Event {
+	return d.watchers.watch()
+}
+
+func (d *FileDiscovery) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.watchers.close()
+	})
+	return nil
+}
+
+func (d *FileDiscovery) loop() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			if err := d.reload(); err != nil {
+				log.Rlog.Warn("file discovery %v reload failed:%v", d.path, err)
+			}
+		}
+	}
+}
+
+// reload 文件有变化时重新读取并投递差异,读取失败时保留原列表
+func (d *FileDiscovery) reload() error {
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if fi.ModTime().Equal(d.modTime) && fi.Size() == d.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	//内容有误时同样记录,避免每次检查重复报错
+	d.modTime, d.size = fi.ModTime(), fi.Size()
+	endpoints, values, err := parseEndpointFile(d.path, data)
+	if err != nil {
+		return err
+	}
+	d.list.replace(endpoints, values, &d.watchers)
+	return nil
+}
+
+// fileEndpoint 文件中的一条服务端配置,未设置 network 时 addr 按 network@addr 解析,
+// 设置 service 时只提供该服务
+type fileEndpoint struct {
+	Service           string `json:"service,omitempty" yaml:"service"`
+	registry.Instance `yaml:",inline"`
+}
+
+// fileConfig YAML/JSON 文件的格式
+type fileConfig struct {
+	Servers []*fileEndpoint `json:"servers" yaml:"servers"`
+}
+
+// parseEndpointFile 按扩展名解析文件,返回注册信息及 key 对应的内容,用于比较变化
+func parseEndpointFile(path string, data []byte) ([]*Endpoint, map[string]string, error) {
+	cfg := &fileConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, nil, err
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return parseEndpointLines(data)
+	}
+	var endpoints []*Endpoint
+	values := make(map[string]string)
+	for i, fe := range cfg.Servers {
+		if fe == nil {
+			return nil, nil, fmt.Errorf("server %d: empty", i)
+		}
+		inst := fe.Instance
+		if len(inst.Network) == 0 {
+			network, addr, err := registry.ParseAddress(inst.Addr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("server %d: %v", i, err)
+			}
+			inst.Network, inst.Addr = network, addr
+		}
+		if err := inst.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("server %d: %v", i, err)
+		}
+		key := inst.Key()
+		if len(fe.Service) > 0 {
+			key = fe.Service + "/" + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, nil, fmt.Errorf("server %d: duplicate server %v", i, key)
+		}
+		val, err := json.Marshal(&fileEndpoint{Service: fe.Service, Instance: inst})
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = string(val)
+		endpoints = append(endpoints, &Endpoint{Key: key, Service: fe.Service, Instance: &inst})
+	}
+	return endpoints, values, nil
+}
+
+// parseEndpointLines 按行解析注册信息,返回注册信息及 key 对应的原始内容
+func parseEndpointLines(data []byte) ([]*Endpoint, map[string]string, error) {
+	var endpoints []*Endpoint
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		inst, err := registry.ParseInstance(line)
+		if err == nil {
+			err = inst.Validate()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		key := inst.Key()
+		if _, ok := values[key]; ok {
+			return nil, nil, fmt.Errorf("line %d: duplicate server %v", n, key)
+		}
+		values[key] = line
+		endpoints = append(endpoints, &Endpoint{Key: key, Instance: inst})
+	}
+	return endpoints, values, scanner.Err()
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/log"
+	"time"
+)
+
+// 异常检测策略的默认值
+const (
+	DefaultConsecutiveFailures = 5
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+	DefaultMaxEjectionPercent  = 50
+	DefaultProbeInterval       = time.Second
+)
+
+// HealthCheckPolicy 异常检测策略,心跳或调用连续失败的服务端暂时从负载均衡中摘除,
+// 摘除时间到后在后台探测,探测成功后重新加入
+type HealthCheckPolicy struct {
+	//ConsecutiveFailures 连续失败多少次后摘除,只统计 Unavailable 与 DeadlineExceeded
+	ConsecutiveFailures int
+	//BaseEjectionTime 摘除时间,探测失败时按失败次数递增,不超过 MaxEjectionTime
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	//MaxEjectionPercent 每个服务最多摘除的服务端百分比,且始终至少保留一个服务端
+	MaxEjectionPercent float64
+	//ProbeInterval 检查摘除时间与探测的间隔,探测超时也使用该值
+	ProbeInterval time.Duration
+}
+
+func (p *HealthCheckPolicy) consecutiveFailures() int {
+	if p.ConsecutiveFailures <= 0 {
+		return DefaultConsecutiveFailures
+	}
+	return p.ConsecutiveFailures
+}
+
+// ejectionTime 第 n 次(从 1 开始)摘除的时长
+func (p *HealthCheckPolicy) ejectionTime(n int) time.Duration {
+	base, limit := p.BaseEjectionTime, p.MaxEjectionTime
+	if base <= 0 {
+		base = DefaultBaseEjectionTime
+	}
+	if limit <= 0 {
+		limit = DefaultMaxEjectionTime
+	}
+	if d := base * time.Duration(n); d < limit {
+		return d
+	}
+	return limit
+}
+
+func (p *HealthCheckPolicy) maxEjectionPercent() float64 {
+	if p.MaxEjectionPercent <= 0 {
+		return DefaultMaxEjectionPercent
+	}
+	return p.MaxEjectionPercent
+}
+
+func (p *HealthCheckPolicy) probeInterval() time.Duration {
+	if p.ProbeInterval <= 0 {
+		return DefaultProbeInterval
+	}
+	return p.ProbeInterval
+}
+
+// endpointHealth 服务端的健康状态
+type endpointHealth struct {
+	//failures 连续失败次数
+	failures int
+	ejected  bool
+	//ejections 本次摘除以来的摘除次数,探测失败时增加
+	ejections int
+	until     time.Time
+}
+
+// healthFailure 是否说明服务端不可用,业务错误与取消不计入
+func healthFailure(err error) bool {
+	switch errors.CodeOf(err) {
+	case errors.Unavailable, errors.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// reportHealth 记录心跳或调用结果,连续失败达到阈值时摘除
+func (c *XClient) reportHealth(name string, err error) {
+	policy := c.option.HealthCheck
+	if policy == nil || errors.CodeOf(err) == errors.Canceled {
+		return
+	}
+	c.healthMu.Lock()
+	h, ok := c.health[name]
+	if !ok || h.ejected {
+		c.healthMu.Unlock()
+		return
+	}
+	if !healthFailure(err) {
+		h.failures = 0
+		c.healthMu.Unlock()
+		return
+	}
+	h.failures++
+	reached := h.failures >= policy.consecutiveFailures()
+	c.healthMu.Unlock()
+	if reached {
+		c.eject(name)
+	}
+}
+
+// eject 把服务端移出负载均衡,超过摘除上限时放弃
+func (c *XClient) eject(name string) {
+	policy := c.option.HealthCheck
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.serverConnPool[name]; !ok || c.ejected[name] {
+		return
+	}
+	if !c.canEject(name, policy.maxEjectionPercent()) {
+		log.Rlog.Debug("server %v unhealthy, ejection limit reached", name)
+		return
+	}
+	c.healthMu.Lock()
+	h, ok := c.health[name]
+	if !ok {
+		c.healthMu.Unlock()
+		return
+	}
+	h.ejected, h.ejections = true, 1
+	h.until = time.Now().Add(policy.ejectionTime(h.ejections))
+	c.healthMu.Unlock()
+	c.ejected[name] = true
+	c.refreshServices(name)
+	log.Rlog.Warn("server %v ejected after %v consecutive failures", name, policy.consecutiveFailures())
+}
+
+// canEject 摘除后包含 name 的每个服务都不超过比例上限且仍有服务端,调用方需持有 c.lock
+func (c *XClient) canEject(name string, percent float64) bool {
+	for _, set := range c.services {
+		if !set.has(name) {
+			continue
+		}
+		n := len(set.keys)
+		ejected := n - len(set.active) + 1
+		if ejected >= n || float64(ejected)*100 > float64(n)*percent {
+			return false
+		}
+	}
+	return true
+}
+
+// restore 把恢复的服务端重新加入负载均衡
+func (c *XClient) restore(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.ejected[name] {
+		return
+	}
+	c.healthMu.Lock()
+	if h, ok := c.health[name]; ok {
+		*h = endpointHealth{}
+	}
+	c.healthMu.Unlock()
+	delete(c.ejected, name)
+	c.refreshServices(name)
+	log.Rlog.Info("server %v recovered", name)
+}
+
+// refreshServices 更新包含 name 的服务的负载均衡,调用方需持有 c.lock
+func (c *XClient) refreshServices(name string) {
+	for _, set := range c.services {
+		if set.has(name) {
+			set.refresh()
+		}
+	}
+}
+
+// healthLoop 定期探测摘除时间已到的服务端
+func (c *XClient) healthLoop() {
+	policy := c.option.HealthCheck
+	ticker := time.NewTicker(policy.probeInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		var due []string
+		c.healthMu.Lock()
+		for name, h := range c.health {
+			if h.ejected && now.After(h.until) {
+				due = append(due, name)
+			}
+		}
+		c.healthMu.Unlock()
+		for _, name := range due {
+			c.probe(name, policy)
+		}
+	}
+}
+
+// probe 探测一个被摘除的服务端,失败时延长摘除时间
+func (c *XClient) probe(name string, policy *HealthCheckPolicy) {
+	c.lock.RLock()
+	pool, ok := c.serverConnPool[name]
+	c.lock.RUnlock()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), policy.probeInterval())
+	err := pool.probe(ctx)
+	cancel()
+	if err == nil {
+		c.restore(name)
+		return
+	}
+	c.healthMu.Lock()
+	if h, ok := c.health[name]; ok && h.ejected {
+		h.ejections++
+		h.until = time.Now().Add(policy.ejectionTime(h.ejections))
+	}
+	c.healthMu.Unlock()
+	log.Rlog.Debug("server %v probe failed:%v", name, err)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func healthOption() *Option {
+	opt := testOption()
+	opt.FailMode = Failfast
+	opt.HealthCheck = &HealthCheckPolicy{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    50 * time.Millisecond,
+		ProbeInterval:       10 * time.Millisecond,
+	}
+	return opt
+}
+
+// activeCount 服务未被摘除的服务端数
+func activeCount(c *XClient, path string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if set := c.service(path); set != nil {
+		return len(set.active)
+	}
+	return 0
+}
+
+func TestHealthEjectAndRecover(t *testing.T) {
+	addr1 := startTestServer(t)
+	addr2 := freeAddr(t)
+	s2 := serveOn(t, addr2)
+	c := newTestXClient(t, healthOption(), addr1, addr2)
+
+	call := func() error {
+		var reply int64
+		return c.Call(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	}
+	_ = s2.Close()
+	failed := 0
+	for i := 0; i < 10; i++ {
+		if call() != nil {
+			failed++
+		}
+	}
+	if failed != 2 || activeCount(c, "Sleeper") != 1 {
+		t.Fatalf("expect server ejected after 2 failures, failed %d active %d", failed, activeCount(c, "Sleeper"))
+	}
+
+	//摘除期间探测失败会延长摘除时间
+	time.Sleep(100 * time.Millisecond)
+	if activeCount(c, "Sleeper") != 1 {
+		t.Fatal("expect server kept ejected while down")
+	}
+	serveOn(t, addr2)
+	waitFor(t, func() bool { return activeCount(c, "Sleeper") == 2 })
+	for i := 0; i < 4; i++ {
+		if err := call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHealthEjectionLimit(t *testing.T) {
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	s1, s2 := serveOn(t, addr1), serveOn(t, addr2)
+	c := newTestXClient(t, healthOption(), addr1, addr2)
+	_, _ = s1.Close(), s2.Close()
+	for i := 0; i < 10; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err == nil {
+			t.Fatal("expect error")
+		}
+	}
+	//最多摘除一半,且始终保留一个服务端
+	if n := activeCount(c, "Sleeper"); n != 1 {
+		t.Fatalf("expect one server kept, got %d", n)
+	}
+}
+
+func TestHealthIgnoresApplicationErrors(t *testing.T) {
+	addr1, addr2 := startTestServer(t), startTestServer(t)
+	c := newTestXClient(t, healthOption(), addr1, addr2)
+	for i := 0; i < 10; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Sleeper", "Missing", int64(0), &reply); err == nil {
+			t.Fatal("expect error")
+		}
+	}
+	if n := activeCount(c, "Sleeper"); n != 2 {
+		t.Fatalf("application errors should not eject, active %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHedgeBudgetPercent 对冲请求默认占总请求数的上限
+	DefaultHedgeBudgetPercent = 10
+	latencyWindowSize         = 128
+	latencyMinSamples         = 20
+)
+
+// HedgePolicy 对冲策略,首次请求在等待时间内未返回时向另一个服务端发送相同请求,
+// 取先成功的响应并取消另一个,只应对幂等方法开启
+type HedgePolicy struct {
+	//Delay 发送对冲请求前的等待时间
+	Delay time.Duration
+	//UseP95 使用该方法观测到的 p95 延迟作为等待时间,样本不足时使用 Delay
+	UseP95 bool
+	//BudgetPercent 对冲请求占总请求数的上限百分比,0 时使用 DefaultHedgeBudgetPercent
+	BudgetPercent float64
+	//Methods 只对其中的 "path.method" 对冲,为空时对所有方法对冲
+	Methods map[string]bool
+}
+
+func (h *HedgePolicy) enabled(name string) bool {
+	return h != nil && (len(h.Methods) == 0 || h.Methods[name])
+}
+
+func (h *HedgePolicy) delay(stats *latencyStats, name string) time.Duration {
+	if h.UseP95 {
+		if d, ok := stats.p95(name); ok {
+			return d
+		}
+	}
+	return h.Delay
+}
+
+// hedgeBudget 统计请求总数与对冲数,限制对冲比例
+type hedgeBudget struct {
+	total  uint64
+	hedged uint64
+}
+
+func (b *hedgeBudget) request() {
+	atomic.AddUint64(&b.total, 1)
+}
+
+// allow 对冲数未超过总数的 percent% 时占用一次对冲配额
+func (b *hedgeBudget) allow(percent float64) bool {
+	if percent <= 0 {
+		percent = DefaultHedgeBudgetPercent
+	}
+	for {
+		hedged := atomic.LoadUint64(&b.hedged)
+		if float64(hedged+1) > float64(atomic.LoadUint64(&b.total))*percent/100 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&b.hedged, hedged, hedged+1) {
+			return true
+		}
+	}
+}
+
+// latencyStats 按方法记录最近成功调用的延迟
+type latencyStats struct {
+	mu      sync.Mutex
+	windows map[string]*latencyWindow
+}
+
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (s *latencyStats) observe(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.windows == nil {
+		s.windows = make(map[string]*latencyWindow)
+	}
+	w, ok := s.windows[name]
+	if !ok {
+		w = &latencyWindow{}
+		s.windows[name] = w
+	}
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// p95 样本数不少于 latencyMinSamples 时返回 p95 延迟
+func (s *latencyStats) p95(name string) (time.Duration, bool) {
+	s.mu.Lock()
+	w, ok := s.windows[name]
+	if !ok || len(w.samples) < latencyMinSamples {
+		s.mu.Unlock()
+		return 0, false
+	}
+	samples := append([]time.Duration(nil), w.samples...)
+	s.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[(len(samples)*95-1)/100], true
+}
+
+// hedgedCall 调用 pool,开启对冲时在等待时间后向 tried 之外的服务端发送对冲请求
+func (c *XClient) hedgedCall(ctx context.Context, key string, pool *connPool, tried map[string]bool, path, method string, arg, reply interface{}) error {
+	name := path + "." + method
+	h := c.option.Hedge
+	if !h.enabled(name) {
+		start := time.Now()
+		err := c.callPool(ctx, key, pool, path, method, arg, reply)
+		if err == nil {
+			c.latency.observe(name, time.Since(start))
+		}
+		return err
+	}
+	c.hedge.request()
+
+	type result struct {
+		err   error
+		reply interface{}
+	}
+	hctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	run := func(k string, p *connPool) {
+		r := newReply(reply)
+		start := time.Now()
+		err := c.callPool(hctx, k, p, path, method, arg, r)
+		if err == nil {
+			c.latency.observe(name, time.Since(start))
+		}
+		results <- result{err: err, reply: r}
+	}
+	go run(key, pool)
+	pending := 1
+
+	timer := time.NewTimer(h.delay(&c.latency, name))
+	defer timer.Stop()
+	var err error
+	for {
+		select {
+		case <-timer.C:
+			hkey, hpool, e := c.pickPool(ctx, path, method, tried)
+			if e != nil || hkey == key || !c.hedge.allow(h.BudgetPercent) {
+				continue
+			}
+			tried[hkey] = true
+			pending++
+			go run(hkey, hpool)
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				setReply(reply, res.reply)
+				return nil
+			}
+			err = res.err
+			if pending == 0 {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/server"
+	"github.com/arch3754/mrpc/util"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Delayed 每次调用延迟 D 后返回
+type Delayed struct {
+	D     time.Duration
+	calls int32
+}
+
+func (d *Delayed) Get(ctx context.Context, arg *int64, reply *int64) error {
+	atomic.AddInt32(&d.calls, 1)
+	time.Sleep(d.D)
+	*reply = *arg
+	return nil
+}
+
+func (d *Delayed) Calls() int32 {
+	return atomic.LoadInt32(&d.calls)
+}
+
+func startDelayedServer(t *testing.T, delay time.Duration) (*Delayed, string) {
+	d := &Delayed{D: delay}
+	s := server.NewServer(time.Minute, time.Minute)
+	if err := s.Register(d); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ln)
+	t.Cleanup(func() { _ = s.Close() })
+	return d, ln.Addr().String()
+}
+
+func TestHedgeSlowPrimary(t *testing.T) {
+	slow, slowAddr := startDelayedServer(t, 500*time.Millisecond)
+	fast, fastAddr := startDelayedServer(t, 0)
+	opt := testOption()
+	opt.Hedge = &HedgePolicy{Delay: 50 * time.Millisecond, BudgetPercent: 100}
+	c := newTestXClient(t, opt, slowAddr, fastAddr)
+
+	start := time.Now()
+	var reply int64
+	if err := c.Call(context.Background(), "Delayed", "Get", int64(4), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Fatalf("hedged call took %v", d)
+	}
+	if reply != 4 {
+		t.Fatalf("expect reply 4, got %d", reply)
+	}
+	if slow.Calls() != 1 || fast.Calls() != 1 {
+		t.Fatalf("expect one call on each server, got slow=%d fast=%d", slow.Calls(), fast.Calls())
+	}
+}
+
+func TestHedgeRequestMetadata(t *testing.T) {
+	_, slowAddr := startDelayedServer(t, 100*time.Millisecond)
+	_, fastAddr := startDelayedServer(t, 100*time.Millisecond)
+	opt := testOption()
+	opt.Hedge = &HedgePolicy{Delay: time.Millisecond, BudgetPercent: 100}
+	c := newTestXClient(t, opt, slowAddr, fastAddr)
+	//对冲请求与原请求共用 ctx 中的元数据
+	meta := map[string]string{"trace": "1"}
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(util.SetRequestMetadata(context.Background(), meta), time.Second)
+		var reply int64
+		err := c.Call(ctx, "Delayed", "Get", int64(4), &reply)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := meta[util.ServerTimeout]; ok || len(meta) != 1 {
+		t.Fatalf("caller metadata modified: %v", meta)
+	}
+}
+
+func TestHedgeNotNeeded(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	d2, addr2 := startDelayedServer(t, 0)
+	opt := testOption()
+	opt.Hedge = &HedgePolicy{Delay: 200 * time.Millisecond, BudgetPercent: 100}
+	c := newTestXClient(t, opt, addr1, addr2)
+	var reply int64
+	if err := c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := d1.Calls() + d2.Calls(); n != 1 {
+		t.Fatalf("fast call should not be hedged, got %d calls", n)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 50*time.Millisecond)
+	d2, addr2 := startDelayedServer(t, 50*time.Millisecond)
+	opt := testOption()
+	opt.Hedge = &HedgePolicy{Delay: 5 * time.Millisecond, BudgetPercent: 20}
+	c := newTestXClient(t, opt, addr1, addr2)
+	for i := 0; i < 10; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Delayed", "Get", int64(i), &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := d1.Calls() + d2.Calls(); n > 12 {
+		t.Fatalf("hedging exceeded 20%% budget: %d calls for 10 requests", n)
+	}
+	if hedged := atomic.LoadUint64(&c.hedge.hedged); hedged != 2 {
+		t.Fatalf("expect 2 hedged requests, got %d", hedged)
+	}
+}
+
+func TestLatencyP95(t *testing.T) {
+	var s latencyStats
+	if _, ok := s.p95("A.Get"); ok {
+		t.Fatal("expect no p95 without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		s.observe("A.Get", time.Duration(i)*time.Millisecond)
+	}
+	d, ok := s.p95("A.Get")
+	if !ok || d != 95*time.Millisecond {
+		t.Fatalf("expect p95 95ms, got %v %v", d, ok)
+	}
+	//超出窗口后只保留最近的样本
+	for i := 0; i < latencyWindowSize; i++ {
+		s.observe("A.Get", time.Millisecond)
+	}
+	if d, _ := s.p95("A.Get"); d != time.Millisecond {
+		t.Fatalf("expect old samples evicted, got %v", d)
+	}
+}
@@ -0,0 +1,25 @@
+package client
+
+import "github.com/arch3754/mrpc/util"
+
+// UnaryInvoker 发送请求并等待响应
+type UnaryInvoker func(ctx *util.Context, path, method string, arg, reply interface{}) error
+
+// UnaryClientInterceptor 客户端拦截器,调用 invoker 继续后续拦截器及实际调用,不调用则直接返回
+type UnaryClientInterceptor func(ctx *util.Context, path, method string, arg, reply interface{}, invoker UnaryInvoker) error
+
+// ChainUnaryClient 将多个拦截器合并为一个,第一个在最外层
+func ChainUnaryClient(interceptors ...UnaryClientInterceptor) UnaryClientInterceptor {
+	return func(ctx *util.Context, path, method string, arg, reply interface{}, invoker UnaryInvoker) error {
+		return chainUnaryInvoker(interceptors, invoker)(ctx, path, method, arg, reply)
+	}
+}
+
+func chainUnaryInvoker(interceptors []UnaryClientInterceptor, final UnaryInvoker) UnaryInvoker {
+	if len(interceptors) == 0 {
+		return final
+	}
+	return func(ctx *util.Context, path, method string, arg, reply interface{}) error {
+		return interceptors[0](ctx, path, method, arg, reply, chainUnaryInvoker(interceptors[1:], final))
+	}
+}
@@ -0,0 +1,288 @@
+package client
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/arch3754/mrpc/errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connPool 同一服务端的一组连接,按在途请求数最少选择连接,
+// 空槽位按需建连,断开的连接在下次选中时重建,空闲连接超时关闭
+type connPool struct {
+	option  *Option
+	network string
+	addr    string
+	mu      sync.Mutex
+	slots   []*poolSlot
+	//onCpuIdle 传给池中每个连接,心跳收到服务端空闲 CPU 时回调
+	onCpuIdle func(idle float64)
+	//onHeartbeat 传给池中每个连接,定时心跳结束时回调结果
+	onHeartbeat func(err error)
+	closed      bool
+	stop        chan struct{}
+}
+
+type poolSlot struct {
+	dialMu   sync.Mutex
+	cli      *client
+	inFlight int64
+	lastUsed int64
+}
+
+func newConnPool(network, addr string, option *Option) *connPool {
+	//连接池自行按需重建断开的连接,单个连接不再自动重连
+	opt := *option
+	opt.ReconnectEnable = false
+	option = &opt
+	size := option.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	p := &connPool{
+		option:  option,
+		network: network,
+		addr:    addr,
+		slots:   make([]*poolSlot, size),
+		stop:    make(chan struct{}),
+	}
+	for i := range p.slots {
+		p.slots[i] = &poolSlot{}
+	}
+	if option.PoolIdleTimeout > 0 {
+		go p.evictLoop()
+	}
+	return p
+}
+
+// healthy 连接已建立且未关闭
+func (s *poolSlot) healthy() bool {
+	return s.cli != nil && !s.cli.isClosed()
+}
+
+// acquire 选择一个连接并占用,调用方用完后必须调用 release
+func (p *connPool) acquire() (*poolSlot, *client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, notSent(errors.Unavailable, stderrors.New("mrpc: connection pool is closed"))
+	}
+	var best, empty *poolSlot
+	for _, s := range p.slots {
+		if s.healthy() {
+			if best == nil || atomic.LoadInt64(&s.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = s
+			}
+		} else if empty == nil || atomic.LoadInt64(&s.inFlight) < atomic.LoadInt64(&empty.inFlight) {
+			empty = s
+		}
+	}
+	//已有连接都在忙时优先在空槽位建新连接
+	target := best
+	if empty != nil && (best == nil || atomic.LoadInt64(&best.inFlight) > 0) {
+		target = empty
+	}
+	atomic.AddInt64(&target.inFlight, 1)
+	cli := target.cli
+	p.mu.Unlock()
+
+	if cli != nil && !cli.isClosed() {
+		return target, cli, nil
+	}
+	cli, err := p.dial(target)
+	if err != nil {
+		p.release(target)
+		return nil, nil, err
+	}
+	return target, cli, nil
+}
+
+// dial 为槽位建连,同一槽位并发建连时只建一次
+func (p *connPool) dial(s *poolSlot) (*client, error) {
+	s.dialMu.Lock()
+	defer s.dialMu.Unlock()
+	p.mu.Lock()
+	if s.healthy() {
+		cli := s.cli
+		p.mu.Unlock()
+		return cli, nil
+	}
+	p.mu.Unlock()
+
+	cli := NewClient(p.option)
+	cli.onCpuIdle = p.onCpuIdle
+	cli.onHeartbeat = p.onHeartbeat
+	if err := cli.Connect(p.network, p.addr); err != nil {
+		if p.option.Breaker != nil {
+			p.option.Breaker.Fail()
+		}
+		return nil, notSent(errors.Unavailable, err)
+	}
+	if p.option.Breaker != nil {
+		p.option.Breaker.Success()
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = cli.Close()
+		return nil, errors.New(errors.Unavailable, "mrpc: connection pool is closed")
+	}
+	s.cli = cli
+	p.mu.Unlock()
+	return cli, nil
+}
+
+func (p *connPool) release(s *poolSlot) {
+	atomic.StoreInt64(&s.lastUsed, time.Now().UnixNano())
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// probe 取一个连接发送心跳,用于检查被摘除的服务端是否恢复
+func (p *connPool) probe(ctx context.Context) error {
+	s, cli, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release(s)
+	var reply int64
+	return cli.heartbeat(ctx, &reply)
+}
+
+// warm 预先建立一个连接,用于发现服务端时检查可用性
+func (p *connPool) warm() error {
+	s, _, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	p.release(s)
+	return nil
+}
+
+func (p *connPool) SyncCall(ctx context.Context, path, method string, arg, reply interface{}) error {
+	s, cli, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release(s)
+	return cli.SyncCall(ctx, path, method, arg, reply)
+}
+
+func (p *connPool) AsyncCall(ctx context.Context, path, method string, arg, reply interface{}) *Caller {
+	caller := &Caller{
+		Path:   path,
+		Method: method,
+		Arg:    arg,
+		Reply:  reply,
+		Done:   make(chan *Caller, 1),
+	}
+	s, cli, err := p.acquire()
+	if err != nil {
+		caller.Error = err
+		caller.Done <- caller
+		return caller
+	}
+	inner := cli.AsyncCall(ctx, path, method, arg, reply)
+	go func() {
+		call := <-inner.Done
+		p.release(s)
+		caller.RequestMetadata = call.RequestMetadata
+		caller.ResponseMetadata = call.ResponseMetadata
+		caller.Error = call.Error
+		caller.Done <- caller
+	}()
+	return caller
+}
+
+// NewStream 流结束前一直计入所在连接的在途请求数
+func (p *connPool) NewStream(ctx context.Context, path, method string) (Stream, error) {
+	s, cli, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	st, err := cli.NewStream(ctx, path, method)
+	if err != nil {
+		p.release(s)
+		return nil, err
+	}
+	go func() {
+		<-st.(*clientStream).done
+		p.release(s)
+	}()
+	return st, nil
+}
+
+// evictLoop 定期关闭空闲超时的连接
+func (p *connPool) evictLoop() {
+	ticker := time.NewTicker(p.option.PoolIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evictIdle()
+		}
+	}
+}
+
+func (p *connPool) evictIdle() {
+	deadline := time.Now().Add(-p.option.PoolIdleTimeout).UnixNano()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.slots {
+		if s.cli == nil || atomic.LoadInt64(&s.inFlight) > 0 || atomic.LoadInt64(&s.lastUsed) > deadline {
+			continue
+		}
+		_ = s.cli.Close()
+		s.cli = nil
+	}
+}
+
+// inFlight 池中所有连接的在途请求数之和
+func (p *connPool) inFlight() int {
+	p.mu.Lock()
+	clients := make([]*client, 0, len(p.slots))
+	for _, s := range p.slots {
+		if s.cli != nil {
+			clients = append(clients, s.cli)
+		}
+	}
+	p.mu.Unlock()
+	n := 0
+	for _, cli := range clients {
+		n += cli.inFlight()
+	}
+	return n
+}
+
+// connCount 当前已建立的连接数
+func (p *connPool) connCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, s := range p.slots {
+		if s.healthy() {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *connPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	for _, s := range p.slots {
+		if s.cli != nil {
+			_ = s.cli.Close()
+			s.cli = nil
+		}
+	}
+	return nil
+}
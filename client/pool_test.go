@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/protocol"
+	"github.com/arch3754/mrpc/server"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Sleeper struct{}
+
+func (s *Sleeper) Sleep(ctx context.Context, arg *int64, reply *int64) error {
+	time.Sleep(time.Duration(*arg) * time.Millisecond)
+	*reply = *arg
+	return nil
+}
+
+func startTestServer(t *testing.T) string {
+	s := server.NewServer(time.Minute, time.Minute)
+	if err := s.Register(new(Sleeper)); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ln)
+	t.Cleanup(func() { _ = s.Close() })
+	return ln.Addr().String()
+}
+
+func testOption() *Option {
+	return &Option{
+		Serialize:      protocol.MsgPack,
+		ConnTimeout:    10 * time.Second,
+		ConnectTimeout: 3 * time.Second,
+		Compress:       protocol.None,
+	}
+}
+
+func TestConnPoolLazyDial(t *testing.T) {
+	addr := startTestServer(t)
+	opt := testOption()
+	opt.PoolSize = 4
+	p := newConnPool("tcp", addr, opt)
+	defer p.Close()
+	if n := p.connCount(); n != 0 {
+		t.Fatalf("expect no connection before first call, got %d", n)
+	}
+	var reply int64
+	for i := 0; i < 10; i++ {
+		if err := p.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//串行调用时一个连接足够
+	if n := p.connCount(); n != 1 {
+		t.Fatalf("expect 1 connection for sequential calls, got %d", n)
+	}
+}
+
+func TestConnPoolLeastInFlight(t *testing.T) {
+	addr := startTestServer(t)
+	opt := testOption()
+	opt.PoolSize = 4
+	p := newConnPool("tcp", addr, opt)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int64
+			if err := p.SyncCall(context.Background(), "Sleeper", "Sleep", int64(200), &reply); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := p.connCount(); n != 4 {
+		t.Fatalf("expect concurrent calls spread over 4 connections, got %d", n)
+	}
+	p.mu.Lock()
+	for i, s := range p.slots {
+		if n := atomic.LoadInt64(&s.inFlight); n != 1 {
+			t.Errorf("slot %d in flight %d, expect 1", i, n)
+		}
+	}
+	p.mu.Unlock()
+	wg.Wait()
+}
+
+func TestConnPoolRedialClosed(t *testing.T) {
+	addr := startTestServer(t)
+	p := newConnPool("tcp", addr, testOption())
+	defer p.Close()
+	if err := p.warm(); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	_ = p.slots[0].cli.Close()
+	p.mu.Unlock()
+
+	var reply int64
+	if err := p.SyncCall(context.Background(), "Sleeper", "Sleep", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 1 {
+		t.Fatalf("expect reply 1, got %d", reply)
+	}
+}
+
+func TestConnPoolIdleEviction(t *testing.T) {
+	addr := startTestServer(t)
+	opt := testOption()
+	opt.PoolIdleTimeout = 100 * time.Millisecond
+	p := newConnPool("tcp", addr, opt)
+	defer p.Close()
+
+	caller := p.AsyncCall(context.Background(), "Sleeper", "Sleep", int64(0), new(int64))
+	if call := <-caller.Done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if n := p.connCount(); n != 1 {
+		t.Fatalf("expect 1 connection, got %d", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := p.connCount(); n != 0 {
+		t.Fatalf("expect idle connection evicted, got %d", n)
+	}
+}
+
+func TestConnPoolDialFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	opt := testOption()
+	opt.ConnectTimeout = 200 * time.Millisecond
+	p := newConnPool("tcp", addr, opt)
+	defer p.Close()
+	var reply int64
+	err = p.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	if err == nil {
+		t.Fatal("expect dial error")
+	}
+	if n := atomic.LoadInt64(&p.slots[0].inFlight); n != 0 {
+		t.Fatalf("failed dial should release slot, in flight %d", n)
+	}
+}
+
+func TestHeartbeatCpuIdle(t *testing.T) {
+	addr := startTestServer(t)
+	opt := testOption()
+	opt.HbsEnable = true
+	opt.HbsInterval = 20 * time.Millisecond
+	opt.HbsTimeout = time.Second
+	p := newConnPool("tcp", addr, opt)
+	defer p.Close()
+	reported := make(chan float64, 1)
+	p.onCpuIdle = func(idle float64) {
+		select {
+		case reported <- idle:
+		default:
+		}
+	}
+	if err := p.warm(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case idle := <-reported:
+		if idle < 0 || idle > 100 {
+			t.Fatalf("unexpected cpu idle %v", idle)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat did not report cpu idle")
+	}
+}
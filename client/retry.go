@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/arch3754/mrpc/errors"
+	"time"
+)
+
+// RetryPolicy 重试策略,重试时由负载均衡选择尚未尝试过的服务端
+type RetryPolicy struct {
+	//MaxAttempts 最多调用次数,包含首次调用,小于等于 1 表示不重试
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	//RetryableCodes 可重试的错误码,为空时只重试 Unavailable
+	RetryableCodes []errors.Code
+	//Idempotent 方法幂等时服务端收到请求后失败也可重试,否则只重试请求未发出(建连或写入失败)的调用
+	Idempotent bool
+	//Methods 按 "path.method" 覆盖的策略
+	Methods map[string]*RetryPolicy
+}
+
+// notSentError 请求未发送到服务端
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+func (e *notSentError) Unwrap() error {
+	return e.err
+}
+
+// notSent 包装未发出请求的错误,非幂等方法也可以安全重试
+func notSent(code errors.Code, err error) *errors.Error {
+	return errors.Wrap(code, &notSentError{err: err})
+}
+
+func isNotSent(err error) bool {
+	var e *notSentError
+	return stderrors.As(err, &e)
+}
+
+// forMethod 返回方法生效的策略,p 为 nil 时返回 nil
+func (p *RetryPolicy) forMethod(path, method string) *RetryPolicy {
+	if p == nil {
+		return nil
+	}
+	if mp, ok := p.Methods[path+"."+method]; ok {
+		return mp
+	}
+	return p
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// shouldRetry 判断失败的调用是否可以重试
+func (p *RetryPolicy) shouldRetry(err error) bool {
+	if p == nil || err == nil {
+		return false
+	}
+	if !p.Idempotent && !isNotSent(err) {
+		return false
+	}
+	code := errors.CodeOf(err)
+	if len(p.RetryableCodes) == 0 {
+		return code == errors.Unavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// wait 等待第 attempt 次重试的退避时间,ctx 截止时间不足时返回 false
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	delay := backoff(p.BaseDelay, p.MaxDelay, attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/server"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Flaky 前 FailN 次调用返回 Unavailable
+type Flaky struct {
+	FailN int32
+	calls int32
+}
+
+func (f *Flaky) Call(ctx context.Context, arg *int64, reply *int64) error {
+	if atomic.AddInt32(&f.calls, 1) <= f.FailN {
+		return errors.New(errors.Unavailable, "flaky")
+	}
+	*reply = *arg
+	return nil
+}
+
+func (f *Flaky) Calls() int32 {
+	return atomic.LoadInt32(&f.calls)
+}
+
+func startFlakyServer(t *testing.T, failN int32) (*server.Server, *Flaky, string) {
+	f := &Flaky{FailN: failN}
+	s := server.NewServer(time.Minute, time.Minute)
+	if err := s.Register(f); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ln)
+	t.Cleanup(func() { _ = s.Close() })
+	return s, f, ln.Addr().String()
+}
+
+// newTestXClient 不连接 etcd,使用固定的服务端地址
+func newTestXClient(t *testing.T, option *Option, addrs ...string) *XClient {
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, "tcp@"+addr)
+	}
+	d, err := NewStaticDiscovery(list...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewXClient(d, option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	_, f, addr := startFlakyServer(t, 2)
+	opt := testOption()
+	opt.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Idempotent: true}
+	c := newTestXClient(t, opt, addr)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(7), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.Calls(); n != 3 {
+		t.Fatalf("expect 3 attempts, got %d", n)
+	}
+}
+
+func TestRetryNonIdempotentReceived(t *testing.T) {
+	_, f, addr := startFlakyServer(t, 2)
+	opt := testOption()
+	opt.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	c := newTestXClient(t, opt, addr)
+	var reply int64
+	err := c.Call(context.Background(), "Flaky", "Call", int64(7), &reply)
+	if errors.CodeOf(err) != errors.Unavailable {
+		t.Fatalf("expect Unavailable, got %v", err)
+	}
+	if n := f.Calls(); n != 1 {
+		t.Fatalf("server received the request, expect no retry, got %d attempts", n)
+	}
+}
+
+func TestRetryNonIdempotentNotSent(t *testing.T) {
+	dead, _, deadAddr := startFlakyServer(t, 0)
+	_, f, addr := startFlakyServer(t, 0)
+	opt := testOption()
+	opt.Retry = &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	c := newTestXClient(t, opt, deadAddr, addr)
+	_ = dead.Close()
+	pool := c.serverConnPool["tcp@"+deadAddr]
+	for deadline := time.Now().Add(time.Second); pool.connCount() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection to closed server still healthy")
+		}
+	}
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(7), &reply); err != nil {
+		t.Fatalf("dial failure should be retried on another server, got %v", err)
+	}
+	if n := f.Calls(); n != 1 {
+		t.Fatalf("expect 1 call on healthy server, got %d", n)
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	_, _, addr := startFlakyServer(t, 100)
+	opt := testOption()
+	opt.Retry = &RetryPolicy{MaxAttempts: 5, BaseDelay: 500 * time.Millisecond, Idempotent: true}
+	c := newTestXClient(t, opt, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var reply int64
+	if err := c.Call(ctx, "Flaky", "Call", int64(7), &reply); err == nil {
+		t.Fatal("expect error")
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Fatalf("retry ignored deadline, took %v", d)
+	}
+}
+
+func TestRetryMethodOverride(t *testing.T) {
+	_, f, addr := startFlakyServer(t, 2)
+	opt := testOption()
+	opt.Retry = &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		Idempotent:  true,
+		Methods:     map[string]*RetryPolicy{"Flaky.Call": {MaxAttempts: 1}},
+	}
+	c := newTestXClient(t, opt, addr)
+	var reply int64
+	if err := c.Call(context.Background(), "Flaky", "Call", int64(7), &reply); err == nil {
+		t.Fatal("expect error without retry")
+	}
+	if n := f.Calls(); n != 1 {
+		t.Fatalf("expect 1 attempt, got %d", n)
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/log"
+	"math/rand"
+	"time"
+)
+
+// ConnState 客户端连接状态
+type ConnState int
+
+const (
+	// Connecting 正在建立连接
+	Connecting ConnState = iota
+	// Ready 连接可用
+	Ready
+	// TransientFailure 连接断开,等待重连
+	TransientFailure
+	// Shutdown 客户端已关闭,不再重连
+	Shutdown
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connecting:
+		return "Connecting"
+	case Ready:
+		return "Ready"
+	case TransientFailure:
+		return "TransientFailure"
+	case Shutdown:
+		return "Shutdown"
+	}
+	return "Invalid"
+}
+
+const (
+	DefaultReconnectBaseDelay = 100 * time.Millisecond
+	DefaultReconnectMaxDelay  = 10 * time.Second
+)
+
+// GetState 返回当前连接状态
+func (c *client) GetState() ConnState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// WaitForStateChange 阻塞直到状态不再是 source 或 ctx 结束,状态改变返回 true
+func (c *client) WaitForStateChange(ctx context.Context, source ConnState) bool {
+	for {
+		c.stateMu.Lock()
+		state, ch := c.state, c.stateCh
+		c.stateMu.Unlock()
+		if state != source {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (c *client) setState(state ConnState) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	//Shutdown 为终态
+	if c.state == state || c.state == Shutdown {
+		return
+	}
+	log.Rlog.Debug("client %v state %v -> %v", c.addr, c.state, state)
+	c.state = state
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+}
+
+// waitForReady 连接未就绪时按 Option.WaitForReady 排队等待或立即失败
+func (c *client) waitForReady(ctx context.Context) error {
+	for {
+		switch state := c.GetState(); state {
+		case Ready:
+			return nil
+		case Shutdown:
+			return errors.New(errors.Unavailable, "mrpc: client is shutdown")
+		default:
+			if !c.Option.WaitForReady {
+				return errors.Errorf(errors.Unavailable, "mrpc: connection is %v", state)
+			}
+			if !c.WaitForStateChange(ctx, state) {
+				return errors.FromError(ctx.Err())
+			}
+		}
+	}
+}
+
+// reconnect 按指数退避重连直到成功或客户端关闭
+func (c *client) reconnect() {
+	for attempt := 0; ; attempt++ {
+		if c.isClosed() {
+			return
+		}
+		c.setState(Connecting)
+		conn, err := c.dial()
+		if err == nil {
+			c.serve(conn)
+			return
+		}
+		c.setState(TransientFailure)
+		delay := backoff(c.Option.ReconnectBaseDelay, c.Option.ReconnectMaxDelay, attempt)
+		log.Rlog.Warn("reconnect %v failed:%v, retry after %v", c.addr, err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.shutdown:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// backoff 第 attempt 次重试前的等待时间,base*2^attempt 封顶 max,并加入 ±20% 抖动
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = DefaultReconnectBaseDelay
+	}
+	if max <= 0 {
+		max = DefaultReconnectMaxDelay
+	}
+	d := base
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	jitter := int64(d) / 5
+	if jitter > 0 {
+		d += time.Duration(rand.Int63n(2*jitter+1) - jitter)
+	}
+	return d
+}
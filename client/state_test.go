@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/server"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func serveOn(t *testing.T, addr string) *server.Server {
+	s := server.NewServer(time.Minute, time.Minute)
+	if err := s.Register(new(Sleeper)); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ln)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// freeAddr 返回一个当前未被占用的本地地址,用于服务端重启后监听同一地址
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func reconnectOption() *Option {
+	opt := testOption()
+	opt.ReconnectEnable = true
+	opt.ReconnectBaseDelay = 20 * time.Millisecond
+	opt.ReconnectMaxDelay = 100 * time.Millisecond
+	return opt
+}
+
+func waitForState(t *testing.T, c *client, want ConnState) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for state := c.GetState(); state != want; state = c.GetState() {
+		if !c.WaitForStateChange(ctx, state) {
+			t.Fatalf("timeout waiting for %v, current %v", want, c.GetState())
+		}
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	s := serveOn(t, addr)
+
+	c := NewClient(reconnectOption())
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if state := c.GetState(); state != Ready {
+		t.Fatalf("expect Ready, got %v", state)
+	}
+	var reply int64
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Close()
+	waitForState(t, c, TransientFailure)
+	var err error
+	//未开启 WaitForReady 时立即失败
+	err = c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	if errors.CodeOf(err) != errors.Unavailable {
+		t.Fatalf("expect Unavailable during outage, got %v", err)
+	}
+
+	serveOn(t, addr)
+	waitForState(t, c, Ready)
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReconnectNoHang(t *testing.T) {
+	addr := startTestServer(t)
+	c := NewClient(reconnectOption())
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	//连接反复断开时,没有超时的调用也必须返回
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				c.breakConn()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				var reply int64
+				_ = c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("calls hang after connection lost")
+	}
+	close(stop)
+}
+
+func TestClientCallOnLostConn(t *testing.T) {
+	addr := startTestServer(t)
+	c := NewClient(testOption())
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//模拟读协程已完成清理但状态尚未切换的间隙
+	c.mu.Lock()
+	c.live = false
+	c.mu.Unlock()
+	errCh := make(chan error, 1)
+	go func() {
+		var reply int64
+		errCh <- c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	}()
+	select {
+	case err := <-errCh:
+		if errors.CodeOf(err) != errors.Unavailable || !isNotSent(err) {
+			t.Fatalf("expect unavailable before sending, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call on lost connection hangs")
+	}
+}
+
+func TestClientWaitForReady(t *testing.T) {
+	addr := freeAddr(t)
+	s := serveOn(t, addr)
+
+	opt := reconnectOption()
+	opt.WaitForReady = true
+	c := NewClient(opt)
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = s.Close()
+	waitForState(t, c, TransientFailure)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		var reply int64
+		done <- c.SyncCall(ctx, "Sleeper", "Sleep", int64(0), &reply)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	serveOn(t, addr)
+	if err := <-done; err != nil {
+		t.Fatalf("queued call should succeed after reconnect, got %v", err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	addr := startTestServer(t)
+	c := NewClient(reconnectOption())
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	changed := make(chan bool, 1)
+	go func() { changed <- c.WaitForStateChange(context.Background(), Ready) }()
+	_ = c.Close()
+	if !<-changed {
+		t.Fatal("expect state change")
+	}
+	if state := c.GetState(); state != Shutdown {
+		t.Fatalf("expect Shutdown, got %v", state)
+	}
+	var reply int64
+	err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply)
+	if errors.CodeOf(err) != errors.Unavailable {
+		t.Fatalf("expect Unavailable after shutdown, got %v", err)
+	}
+}
+
+func TestClientReconnectDisabled(t *testing.T) {
+	addr := freeAddr(t)
+	s := serveOn(t, addr)
+	c := NewClient(testOption())
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	waitForState(t, c, Shutdown)
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	for attempt := 0; attempt < 10; attempt++ {
+		want := base << uint(attempt)
+		if want > max {
+			want = max
+		}
+		d := backoff(base, max, attempt)
+		if d < want*4/5 || d > want*6/5 {
+			t.Fatalf("attempt %d: backoff %v out of range around %v", attempt, d, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/arch3754/mrpc/codec"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/protocol"
+	"io"
+	"sync"
+)
+
+// Stream 客户端流,对应服务端签名为 func(ctx context.Context, stream server.Stream) error 的方法
+type Stream interface {
+	Context() context.Context
+	// Send 发送一条消息,发送窗口耗尽时阻塞直到服务端消费,服务端结束流后返回 io.EOF
+	Send(m interface{}) error
+	// Recv 接收一条消息,服务端正常结束流后返回 io.EOF,否则返回服务端的错误
+	Recv(m interface{}) error
+	// CloseSend 通知服务端不再发送,之后仍可 Recv
+	CloseSend() error
+}
+
+type clientStream struct {
+	c          *client
+	ctx        context.Context
+	cancel     context.CancelFunc
+	seq        uint64
+	codec      codec.Codec
+	sendWindow *protocol.SendWindow
+	recv       *protocol.RecvBuffer
+	closeSend  sync.Once
+	finishOnce sync.Once
+	done       chan struct{}
+}
+
+// NewStream 在当前连接上打开一个流,ctx 取消时通知服务端取消该流
+func (c *client) NewStream(ctx context.Context, path, method string) (Stream, error) {
+	cdc, ok := codec.CodecMap[c.Option.Serialize]
+	if !ok {
+		return nil, errors.Errorf(errors.InvalidArgument, "mrpc: unsupported serialize type: %d", c.Option.Serialize)
+	}
+	if err := c.waitForReady(ctx); err != nil {
+		return nil, err
+	}
+	meta := requestMetadata(ctx)
+	sctx, cancel := context.WithCancel(ctx)
+	st := &clientStream{
+		c:          c,
+		ctx:        sctx,
+		cancel:     cancel,
+		codec:      cdc,
+		sendWindow: protocol.NewSendWindow(protocol.DefaultStreamWindow),
+		recv:       protocol.NewRecvBuffer(protocol.DefaultStreamWindow),
+		done:       make(chan struct{}),
+	}
+	c.mu.Lock()
+	if !c.live {
+		c.mu.Unlock()
+		cancel()
+		return nil, notSent(errors.Unavailable, stderrors.New("mrpc: connection is closing"))
+	}
+	st.seq = c.seq
+	c.seq++
+	if c.streamMap == nil {
+		c.streamMap = make(map[uint64]*clientStream)
+	}
+	c.streamMap[st.seq] = st
+	c.mu.Unlock()
+
+	msg := protocol.NewStreamMessage(protocol.StreamOpen, st.seq)
+	msg.Path = path
+	msg.Method = method
+	msg.SetSerialize(c.Option.Serialize)
+	msg.SetCompress(c.Option.Compress)
+	msg.Metadata = meta
+	if err := c.writeMessage(msg); err != nil {
+		err = errors.Wrap(errors.Unavailable, err)
+		st.finish(err)
+		return nil, err
+	}
+	go st.watchCancel()
+	return st, nil
+}
+
+func (c *client) writeMessage(msg *protocol.Message) error {
+	conn := c.getConn()
+	if conn == nil {
+		return errors.New(errors.Unavailable, "mrpc: client is not connected")
+	}
+	_, err := conn.Write(*msg.Encode())
+	return err
+}
+
+// handleStreamMessage 在读协程中分发服务端发来的流消息,不会阻塞
+func (c *client) handleStreamMessage(msg *protocol.Message, decodeErr error) {
+	c.mu.Lock()
+	st := c.streamMap[msg.Seq()]
+	c.mu.Unlock()
+	if st == nil {
+		return
+	}
+	if decodeErr != nil {
+		st.finish(errors.Wrap(errors.InvalidArgument, decodeErr))
+		return
+	}
+	switch msg.MessageType() {
+	case protocol.StreamData:
+		st.recv.Push(msg.Payload)
+	case protocol.StreamHalfClose:
+		if msg.Status() == protocol.Error {
+			st.finish(errors.FromMetadata(msg.Metadata))
+		} else {
+			st.finish(io.EOF)
+		}
+	case protocol.StreamWindowUpdate:
+		st.sendWindow.Release(int64(protocol.WindowUpdateSize(msg)))
+	}
+}
+
+// closeStreams 连接断开时结束所有流
+func (c *client) closeStreams(err error) {
+	c.mu.Lock()
+	streams := make([]*clientStream, 0, len(c.streamMap))
+	for _, st := range c.streamMap {
+		streams = append(streams, st)
+	}
+	c.mu.Unlock()
+	for _, st := range streams {
+		st.finish(err)
+	}
+}
+
+func (st *clientStream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *clientStream) Send(m interface{}) error {
+	data, err := st.codec.Encode(m)
+	if err != nil {
+		return errors.Wrap(errors.InvalidArgument, err)
+	}
+	if err = st.sendWindow.Acquire(st.ctx, len(data)); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return errors.FromError(err)
+	}
+	msg := protocol.NewStreamMessage(protocol.StreamData, st.seq)
+	msg.SetSerialize(st.c.Option.Serialize)
+	msg.SetCompress(st.c.Option.Compress)
+	msg.Payload = data
+	if err = st.c.writeMessage(msg); err != nil {
+		return errors.Wrap(errors.Unavailable, err)
+	}
+	return nil
+}
+
+func (st *clientStream) Recv(m interface{}) error {
+	payload, update, err := st.recv.Pop(st.ctx)
+	if err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return errors.FromError(err)
+	}
+	if update > 0 {
+		_ = st.c.writeMessage(protocol.NewWindowUpdate(st.seq, update))
+	}
+	if err = st.codec.Decode(payload, m); err != nil {
+		return errors.Wrap(errors.Internal, err)
+	}
+	return nil
+}
+
+func (st *clientStream) CloseSend() error {
+	var err error
+	st.closeSend.Do(func() {
+		st.sendWindow.Close(errors.New(errors.FailedPrecondition, "mrpc: send on closed stream"))
+		if e := st.c.writeMessage(protocol.NewStreamMessage(protocol.StreamHalfClose, st.seq)); e != nil {
+			err = errors.Wrap(errors.Unavailable, e)
+		}
+	})
+	return err
+}
+
+// watchCancel ctx 取消时通知服务端并结束流
+func (st *clientStream) watchCancel() {
+	select {
+	case <-st.done:
+	case <-st.ctx.Done():
+		select {
+		case <-st.done:
+			return
+		default:
+		}
+		_ = st.c.writeMessage(protocol.NewStreamMessage(protocol.StreamCancel, st.seq))
+		st.finish(errors.FromError(st.ctx.Err()))
+	}
+}
+
+// finish 结束流,已缓冲的消息仍可 Recv,之后返回 err
+func (st *clientStream) finish(err error) {
+	st.finishOnce.Do(func() {
+		st.c.mu.Lock()
+		delete(st.c.streamMap, st.seq)
+		st.c.mu.Unlock()
+		st.recv.CloseWithError(err)
+		st.sendWindow.Close(err)
+		close(st.done)
+		st.cancel()
+	})
+}
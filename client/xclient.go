@@ -0,0 +1,554 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/lb"
+	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/registry"
+	"github.com/arch3754/mrpc/util"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// XClient 从 Discovery 获取服务端,按服务维护连接池与负载均衡
+type XClient struct {
+	//hedge 包含 64 位原子计数,放在首位保证 32 位平台上对齐
+	hedge          hedgeBudget
+	option         *Option
+	discovery      Discovery
+	serverConnPool map[string]*connPool
+	serverKeyList  []string
+	instances      map[string]*registry.Instance
+	//services 服务名到服务端集合,"" 为未区分服务的注册
+	services map[string]*serviceSet
+	//registered 注册 key 到其注册的服务端,refs 为服务端被引用的 key 数
+	registered map[string]registration
+	refs       map[string]int
+	lock       sync.RWMutex
+	newLB      func() lb.LoadBalancer
+	latency    latencyStats
+	//ejected 被异常检测摘除的服务端,由 c.lock 保护;health 由 healthMu 保护
+	ejected  map[string]bool
+	healthMu sync.Mutex
+	health   map[string]*endpointHealth
+	//breakers 服务端到其熔断器,"" 为服务端共用的熔断器,其他为方法的熔断器
+	breakerMu sync.Mutex
+	breakers  map[string]map[string]*circuitBreaker
+	closed    int32
+	done      chan struct{}
+	shutdown  chan struct{}
+}
+
+// registration 一个注册 key 对应的服务端及服务名
+type registration struct {
+	name     string
+	services []string
+}
+
+// serviceSet 提供某个服务的服务端及其负载均衡,active 为未被摘除的服务端
+type serviceSet struct {
+	keys    []string
+	active  []string
+	refs    map[string]int
+	lb      lb.LoadBalancer
+	ejected map[string]bool
+}
+
+func (s *serviceSet) add(name string) {
+	if s.refs[name]++; s.refs[name] == 1 {
+		s.keys = append(s.keys, name)
+		s.refresh()
+	}
+}
+
+func (s *serviceSet) remove(name string) {
+	if s.refs[name]--; s.refs[name] > 0 {
+		return
+	}
+	delete(s.refs, name)
+	keys := make([]string, 0, len(s.keys))
+	for _, v := range s.keys {
+		if v != name {
+			keys = append(keys, v)
+		}
+	}
+	s.keys = keys
+	s.refresh()
+}
+
+// refresh 按摘除情况更新负载均衡的服务端列表
+func (s *serviceSet) refresh() {
+	active := make([]string, 0, len(s.keys))
+	for _, v := range s.keys {
+		if !s.ejected[v] {
+			active = append(active, v)
+		}
+	}
+	s.active = active
+	s.lb.UpdateAddrs(s.active)
+}
+
+func (s *serviceSet) has(name string) bool {
+	return s.refs[name] > 0
+}
+
+// NewXClient 创建使用 discovery 的客户端,XClient 关闭时同时关闭 discovery
+func NewXClient(discovery Discovery, option *Option) (*XClient, error) {
+	if option == nil {
+		option = DefaultOption
+	}
+	newLB, ok := lb.LoadBalancerMap[option.LoadBalance]
+	if !ok {
+		newLB = lb.LoadBalancerMap[lb.RoundRobin]
+	}
+	c := &XClient{
+		option:         option,
+		discovery:      discovery,
+		serverConnPool: make(map[string]*connPool),
+		instances:      make(map[string]*registry.Instance),
+		services:       make(map[string]*serviceSet),
+		registered:     make(map[string]registration),
+		refs:           make(map[string]int),
+		ejected:        make(map[string]bool),
+		health:         make(map[string]*endpointHealth),
+		breakers:       make(map[string]map[string]*circuitBreaker),
+		done:           make(chan struct{}),
+		shutdown:       make(chan struct{}),
+	}
+	c.setLoadBalancer(newLB)
+	//先订阅再获取列表,期间的变化由事件补齐
+	ch := discovery.Watch()
+	endpoints, err := discovery.GetServices()
+	if err != nil {
+		_ = discovery.Close()
+		return nil, err
+	}
+	//初始列表并发建连,等待完成后再返回
+	var wg sync.WaitGroup
+	for _, ep := range endpoints {
+		if name, pool := c.addEndpoint(ep); pool != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.warm(name, pool)
+			}()
+		}
+	}
+	wg.Wait()
+	go c.watch(ch)
+	if option.HealthCheck != nil {
+		go c.healthLoop()
+	}
+	return c, nil
+}
+
+// watch 按顺序应用服务发现的事件,直到 discovery 关闭
+func (c *XClient) watch(ch <-chan *Event) {
+	defer close(c.done)
+	for ev := range ch {
+		switch ev.Type {
+		case EventAdd, EventUpdate:
+			//建连可能较慢,不阻塞后续事件
+			if name, pool := c.addEndpoint(&ev.Endpoint); pool != nil {
+				go c.warm(name, pool)
+			}
+		case EventRemove:
+			c.removeEndpoint(ev.Key)
+		}
+	}
+}
+
+// Close 关闭 discovery 与所有连接
+func (c *XClient) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.shutdown)
+	err := c.discovery.Close()
+	<-c.done
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, pool := range c.serverConnPool {
+		_ = pool.Close()
+		delete(c.serverConnPool, name)
+	}
+	c.serverKeyList = nil
+	c.instances = make(map[string]*registry.Instance)
+	c.services = make(map[string]*serviceSet)
+	c.registered = make(map[string]registration)
+	c.refs = make(map[string]int)
+	c.ejected = make(map[string]bool)
+	c.healthMu.Lock()
+	c.health = make(map[string]*endpointHealth)
+	c.healthMu.Unlock()
+	c.breakerMu.Lock()
+	c.breakers = make(map[string]map[string]*circuitBreaker)
+	c.breakerMu.Unlock()
+	return err
+}
+
+// setLoadBalancer 设置负载均衡的创建方法,每个服务使用独立的负载均衡
+func (c *XClient) setLoadBalancer(newLB func() lb.LoadBalancer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.newLB = newLB
+	for _, set := range c.services {
+		set.lb = c.createLB()
+		set.lb.UpdateAddrs(set.active)
+	}
+}
+
+// createLB 创建负载均衡并提供在途请求数与注册权重查询
+func (c *XClient) createLB() lb.LoadBalancer {
+	l := c.newLB()
+	if a, ok := l.(lb.InFlightAware); ok {
+		a.SetInFlight(c.inFlight)
+	}
+	if a, ok := l.(lb.WeightAware); ok {
+		a.SetWeight(c.weight)
+	}
+	return l
+}
+
+// service 返回提供 path 的服务端集合,没有按服务注册时使用未区分服务的注册,调用方需持有 c.lock
+func (c *XClient) service(path string) *serviceSet {
+	if set, ok := c.services[path]; ok {
+		return set
+	}
+	return c.services[""]
+}
+
+// balancer 返回 path 当前使用的负载均衡
+func (c *XClient) balancer(path string) lb.LoadBalancer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if set := c.service(path); set != nil {
+		return set.lb
+	}
+	return nil
+}
+
+// inFlight 服务端 addr 的在途请求数
+func (c *XClient) inFlight(addr string) int {
+	c.lock.RLock()
+	pool, ok := c.serverConnPool[addr]
+	c.lock.RUnlock()
+	if !ok {
+		return 0
+	}
+	return pool.inFlight()
+}
+
+// weight 服务端 addr 注册的权重,0 表示未设置
+func (c *XClient) weight(addr string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if inst, ok := c.instances[addr]; ok {
+		return inst.Weight
+	}
+	return 0
+}
+
+// updateWeight 把服务端 cpu 空闲率同步给包含它的服务的负载均衡
+func (c *XClient) updateWeight(name string, idle float64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, set := range c.services {
+		if w, ok := set.lb.(lb.WeightedLoadBalancer); ok && set.has(name) {
+			w.UpdateWeight(name, idle)
+		}
+	}
+}
+
+// callPool 经熔断器放行后调用 pool,并把耗时与结果反馈给熔断器与负载均衡,被取消的调用不反馈
+func (c *XClient) callPool(ctx context.Context, key string, pool *connPool, path, method string, arg, reply interface{}) error {
+	b := c.breaker(key, path, method)
+	var generation uint64
+	if b != nil {
+		var ok bool
+		if generation, ok = b.allow(time.Now()); !ok {
+			return errBreakerOpen(b.name)
+		}
+	}
+	start := time.Now()
+	err := pool.SyncCall(ctx, path, method, arg, reply)
+	cost := time.Since(start)
+	if b != nil {
+		b.done(generation, err, cost, time.Now())
+	}
+	c.reportHealth(key, err)
+	if fb, ok := c.balancer(path).(lb.Feedback); ok && errors.CodeOf(err) != errors.Canceled {
+		fb.Feedback(key, cost, err)
+	}
+	return err
+}
+
+func (c *XClient) getPool(ctx context.Context, path, method string) (*connPool, error) {
+	_, pool, err := c.pickPool(ctx, path, method, nil)
+	return pool, err
+}
+
+// pickPool 由负载均衡在提供 path 的服务端中选择,跳过熔断的服务端,
+// 尽量跳过 tried 中已尝试过的,全部尝试过时允许重复
+func (c *XClient) pickPool(ctx context.Context, path, method string, tried map[string]bool) (string, *connPool, error) {
+	c.lock.RLock()
+	set := c.service(path)
+	var (
+		l lb.LoadBalancer
+		n int
+	)
+	if set != nil {
+		l, n = set.lb, len(set.active)
+	}
+	c.lock.RUnlock()
+	if c.option.Breaker != nil && !c.option.Breaker.Ready() {
+		return "", nil, errors.New(errors.Unavailable, "breaker ready")
+	}
+	if l == nil {
+		return "", nil, lb.ErrNoEndpoints
+	}
+	if n == 0 {
+		n = 1
+	}
+	//按 key 路由时同一 key 总是选中同一服务端,改为依次尝试哈希环上的不同服务端
+	var candidates []string
+	if hs, ok := l.(lb.HashSelector); ok {
+		if hk, ok := lb.HashKey(ctx); ok {
+			if candidates = hs.SelectN(hk, n); len(candidates) == 0 {
+				return "", nil, lb.ErrNoEndpoints
+			}
+			n = len(candidates)
+		}
+	}
+	//负载均衡可能回调 inFlight,选择时不持有 c.lock
+	var key, fallback string
+	for i := 0; i < n; i++ {
+		var k string
+		if candidates != nil {
+			k = candidates[i]
+		} else {
+			var err error
+			if k, err = l.Get(ctx); err != nil {
+				return "", nil, err
+			}
+		}
+		if !c.breakerReady(k, path, method) {
+			continue
+		}
+		if !tried[k] {
+			key = k
+			break
+		}
+		if len(fallback) == 0 {
+			fallback = k
+		}
+	}
+	if len(key) == 0 {
+		key = fallback
+	}
+	if len(key) == 0 {
+		return "", nil, notSent(errors.Unavailable, fmt.Errorf("mrpc: circuit breakers of all servers for %v are open", path))
+	}
+	c.lock.RLock()
+	pool, ok := c.serverConnPool[key]
+	c.lock.RUnlock()
+	if !ok {
+		return "", nil, errors.New(errors.Unavailable, "not available service")
+	}
+	return key, pool, nil
+}
+func (c *XClient) Call(ctx context.Context, path, method string, arg, reply interface{}) error {
+	switch mode := failModeFrom(ctx, c.option.FailMode); mode {
+	case Failfast:
+		key, pool, err := c.pickPool(ctx, path, method, nil)
+		if err != nil {
+			return err
+		}
+		return c.callPool(ctx, key, pool, path, method, arg, reply)
+	case Failtry:
+		return c.callFailtry(ctx, path, method, arg, reply)
+	case Broadcast, Forking:
+		return c.callAll(ctx, mode, path, method, arg, reply)
+	default:
+		return c.callFailover(ctx, path, method, arg, reply)
+	}
+}
+
+// AsyncCall 在独立的 goroutine 中按 Call 调用,与 Call 一样经过 FailMode、熔断、
+// 健康检查与负载均衡反馈,完成后通知 Caller.Done
+func (c *XClient) AsyncCall(ctx context.Context, path, method string, arg, reply interface{}) *Caller {
+	caller := &Caller{
+		Path:   path,
+		Method: method,
+		Arg:    arg,
+		Reply:  reply,
+		Done:   make(chan *Caller, 1),
+	}
+	caller.RequestMetadata, _ = ctx.Value(util.RequestMetaData).(map[string]string)
+	uctx, ok := ctx.(*util.Context)
+	if !ok {
+		uctx = util.NewContext(ctx)
+	}
+	go func() {
+		caller.Error = c.Call(uctx, path, method, arg, reply)
+		caller.ResponseMetadata, _ = uctx.Value(util.ResponseMetaData).(map[string]string)
+		caller.Done <- caller
+	}()
+	return caller
+}
+
+// NewStream 在选中的连接上打开一个流
+func (c *XClient) NewStream(ctx context.Context, path, method string) (Stream, error) {
+	pool, err := c.getPool(ctx, path, method)
+	if err != nil {
+		return nil, err
+	}
+	return pool.NewStream(ctx, path, method)
+}
+
+// addEndpoint 处理注册信息的新增或更新,地址不变时只更新实例信息,
+// 新的服务端返回其连接池,由调用方调用 warm 建连
+func (c *XClient) addEndpoint(ep *Endpoint) (string, *connPool) {
+	inst := ep.Instance
+	name := inst.Key()
+	if !inst.SupportsCodec(c.option.Serialize) {
+		log.Rlog.Warn("server %v does not support serialize type %v", name, c.option.Serialize)
+		c.removeEndpoint(ep.Key)
+		return name, nil
+	}
+	if c.option.InstanceFilter != nil && !c.option.InstanceFilter(inst) {
+		log.Rlog.Debug("server %v filtered out", name)
+		c.removeEndpoint(ep.Key)
+		return name, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pool, exist := c.serverConnPool[name]
+	if !exist {
+		pool = newConnPool(inst.Network, inst.Addr, c.option)
+		pool.onCpuIdle = func(idle float64) {
+			c.updateWeight(name, idle)
+		}
+		pool.onHeartbeat = func(err error) {
+			c.reportHealth(name, err)
+		}
+		c.serverConnPool[name] = pool
+		c.serverKeyList = append(c.serverKeyList, name)
+		c.healthMu.Lock()
+		c.health[name] = &endpointHealth{}
+		c.healthMu.Unlock()
+		c.breakerMu.Lock()
+		c.breakers[name] = make(map[string]*circuitBreaker)
+		c.breakerMu.Unlock()
+	}
+	c.instances[name] = inst
+	//先加入新的注册再释放旧的,服务端不变时不会关闭连接
+	old, ok := c.registered[ep.Key]
+	r := registration{name: name, services: ep.services()}
+	c.registered[ep.Key] = r
+	c.acquire(r)
+	if ok {
+		c.release(old)
+	}
+	if exist {
+		return name, nil
+	}
+	return name, pool
+}
+
+// warm 预先建立连接。失败时保留服务端,调用时按需重新建连,
+// 开启异常检测时先摘除,由探测在服务端恢复后重新加入
+func (c *XClient) warm(name string, pool *connPool) {
+	err := pool.warm()
+	if err == nil || atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	c.lock.RLock()
+	current := c.serverConnPool[name]
+	c.lock.RUnlock()
+	if current != pool {
+		//服务端已被删除
+		return
+	}
+	log.Rlog.Warn("server %v connect failed:%v", name, err)
+	if c.option.HealthCheck != nil {
+		c.eject(name)
+	}
+}
+
+// removeEndpoint 处理注册信息的删除
+func (c *XClient) removeEndpoint(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.registered[key]
+	if !ok {
+		return
+	}
+	delete(c.registered, key)
+	c.release(r)
+}
+
+// acquire 把服务端加入注册的各个服务,调用方需持有 c.lock
+func (c *XClient) acquire(r registration) {
+	c.refs[r.name]++
+	for _, s := range r.services {
+		set, ok := c.services[s]
+		if !ok {
+			set = &serviceSet{refs: make(map[string]int), lb: c.createLB(), ejected: c.ejected}
+			c.services[s] = set
+		}
+		set.add(r.name)
+	}
+}
+
+// release 把服务端移出注册的各个服务,不再被任何 key 引用时关闭连接,调用方需持有 c.lock
+func (c *XClient) release(r registration) {
+	for _, s := range r.services {
+		set, ok := c.services[s]
+		if !ok {
+			continue
+		}
+		if set.remove(r.name); len(set.keys) == 0 {
+			delete(c.services, s)
+		}
+	}
+	if c.refs[r.name]--; c.refs[r.name] > 0 {
+		return
+	}
+	delete(c.refs, r.name)
+	if pool, ok := c.serverConnPool[r.name]; ok {
+		_ = pool.Close()
+	}
+	delete(c.serverConnPool, r.name)
+	delete(c.instances, r.name)
+	delete(c.ejected, r.name)
+	c.healthMu.Lock()
+	delete(c.health, r.name)
+	c.healthMu.Unlock()
+	c.breakerMu.Lock()
+	delete(c.breakers, r.name)
+	c.breakerMu.Unlock()
+	list := make([]string, 0, len(c.serverKeyList))
+	for _, v := range c.serverKeyList {
+		if v != r.name {
+			list = append(list, v)
+		}
+	}
+	c.serverKeyList = list
+}
+
+// Instances 返回当前可用服务端的注册信息
+func (c *XClient) Instances() []*registry.Instance {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	list := make([]*registry.Instance, 0, len(c.serverKeyList))
+	for _, name := range c.serverKeyList {
+		if inst, ok := c.instances[name]; ok {
+			list = append(list, inst)
+		}
+	}
+	return list
+}
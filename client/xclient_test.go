@@ -0,0 +1,257 @@
+package client
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/lb"
+	"github.com/arch3754/mrpc/protocol"
+	"github.com/arch3754/mrpc/registry"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestXClientHashKey(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	d2, addr2 := startDelayedServer(t, 0)
+	c := newTestXClient(t, testOption(), addr1, addr2)
+	c.setLoadBalancer(lb.LoadBalancerMap[lb.ConsistentHash])
+
+	ctx := lb.WithHashKey(context.Background(), "shard-7")
+	for i := 0; i < 10; i++ {
+		var reply int64
+		if err := c.Call(ctx, "Delayed", "Get", int64(i), &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n1, n2 := d1.Calls(), d2.Calls(); n1+n2 != 10 || (n1 != 0 && n2 != 0) {
+		t.Fatalf("expect all calls with the same key on one server, got %d and %d", n1, n2)
+	}
+}
+
+type feedbackLB struct {
+	lb.RoundRobinLoadBalancer
+	mu      sync.Mutex
+	results map[string][]error
+}
+
+func (f *feedbackLB) Feedback(addr string, latency time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[addr] = append(f.results[addr], err)
+}
+
+func TestXClientFeedback(t *testing.T) {
+	_, addr := startDelayedServer(t, 0)
+	c := newTestXClient(t, testOption(), addr)
+	fb := &feedbackLB{results: make(map[string][]error)}
+	c.setLoadBalancer(func() lb.LoadBalancer { return fb })
+	var reply int64
+	if err := c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(context.Background(), "Delayed", "Missing", int64(1), &reply); err == nil {
+		t.Fatal("expect error")
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	res := fb.results["tcp@"+addr]
+	if len(res) != 2 || res[0] != nil || res[1] == nil {
+		t.Fatalf("unexpected feedback %v", res)
+	}
+}
+
+func TestXClientLeastRequest(t *testing.T) {
+	slow, slowAddr := startDelayedServer(t, 300*time.Millisecond)
+	fast, fastAddr := startDelayedServer(t, 0)
+	c := newTestXClient(t, testOption(), slowAddr, fastAddr)
+	c.setLoadBalancer(lb.LoadBalancerMap[lb.LeastRequest])
+
+	caller := c.AsyncCall(context.Background(), "Delayed", "Get", int64(0), new(int64))
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Delayed", "Get", int64(i), &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-caller.Done
+	if slow.Calls() != 1 || fast.Calls() != 5 {
+		t.Fatalf("expect calls to avoid busy server, got slow=%d fast=%d", slow.Calls(), fast.Calls())
+	}
+}
+
+func TestXClientInstanceMetadata(t *testing.T) {
+	_, addr1 := startDelayedServer(t, 0)
+	_, addr2 := startDelayedServer(t, 0)
+	opt := testOption()
+	opt.InstanceFilter = func(inst *registry.Instance) bool {
+		return inst.Zone == "sh-a"
+	}
+	c := newTestXClient(t, opt)
+	put := func(addr string, inst *registry.Instance) {
+		c.addEndpoint(&Endpoint{Key: "tcp@" + addr, Instance: inst})
+	}
+	put(addr1, &registry.Instance{Network: "tcp", Addr: addr1, Zone: "sh-a", Weight: 10})
+	put(addr2, &registry.Instance{Network: "tcp", Addr: addr2, Zone: "bj-b"})
+	//没有元数据的注册信息不满足路由规则
+	put(addr2, &registry.Instance{Network: "tcp", Addr: addr2})
+	insts := c.Instances()
+	if len(insts) != 1 || insts[0].Addr != addr1 || insts[0].Weight != 10 {
+		t.Fatalf("unexpected instances %+v", insts)
+	}
+
+	//地址不变的更新只替换实例信息,不重建连接
+	pool := c.serverConnPool["tcp@"+addr1]
+	put(addr1, &registry.Instance{Network: "tcp", Addr: addr1, Zone: "sh-a", Version: "v2"})
+	if c.serverConnPool["tcp@"+addr1] != pool || c.Instances()[0].Version != "v2" {
+		t.Fatal("metadata update should keep the existing pool")
+	}
+
+	//更新后不再满足路由规则时移除
+	put(addr1, &registry.Instance{Network: "tcp", Addr: addr1, Zone: "bj-b"})
+	if len(c.Instances()) != 0 {
+		t.Fatal("instance leaving the zone should be removed")
+	}
+
+	put(addr1, &registry.Instance{Network: "tcp", Addr: addr1, Zone: "sh-a", Codecs: []protocol.Serialize{protocol.Json}})
+	if len(c.Instances()) != 0 {
+		t.Fatal("instance without the client's codec should be skipped")
+	}
+	put(addr1, &registry.Instance{Network: "tcp", Addr: addr1, Zone: "sh-a"})
+	var reply int64
+	if err := c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	c.removeEndpoint("tcp@" + addr1)
+	if len(c.Instances()) != 0 || len(c.serverKeyList) != 0 {
+		t.Fatal("expect instance removed by key")
+	}
+}
+
+func TestXClientServiceRouting(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	d2, addr2 := startDelayedServer(t, 0)
+	c := newTestXClient(t, testOption())
+	ep := func(service, addr string, services ...string) *Endpoint {
+		return &Endpoint{
+			Key:      service + "/tcp@" + addr,
+			Service:  service,
+			Instance: &registry.Instance{Network: "tcp", Addr: addr, Services: services},
+		}
+	}
+	c.addEndpoint(ep("Delayed", addr1, "Delayed", "Other"))
+	c.addEndpoint(ep("Other", addr1, "Delayed", "Other"))
+	c.addEndpoint(ep("Other", addr2, "Other"))
+	if len(c.serverConnPool) != 2 {
+		t.Fatalf("expect one pool per server, got %d", len(c.serverConnPool))
+	}
+
+	for i := 0; i < 6; i++ {
+		var reply int64
+		if err := c.Call(context.Background(), "Delayed", "Get", int64(i), &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reply int64
+	if err := c.Call(WithFailMode(context.Background(), Broadcast), "Delayed", "Get", int64(0), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if d1.Calls() != 7 || d2.Calls() != 0 {
+		t.Fatalf("expect calls only on servers of the service, got %d and %d", d1.Calls(), d2.Calls())
+	}
+
+	//同一服务端的其他 key 仍在时保留连接
+	pool := c.serverConnPool["tcp@"+addr1]
+	c.removeEndpoint("Delayed/tcp@" + addr1)
+	if c.serverConnPool["tcp@"+addr1] != pool {
+		t.Fatal("pool should be kept while other services reference it")
+	}
+	if err := c.Call(context.Background(), "Delayed", "Get", int64(0), &reply); errors.CodeOf(err) != errors.Unavailable {
+		t.Fatalf("expect unavailable without servers of the service, got %v", err)
+	}
+
+	//未指定服务名时按注册信息中的服务列表路由
+	c.addEndpoint(ep("", addr2, "Delayed"))
+	if err := c.Call(context.Background(), "Delayed", "Get", int64(0), &reply); err != nil || d2.Calls() != 1 {
+		t.Fatalf("expect legacy registration routed by its services, err %v calls %d", err, d2.Calls())
+	}
+	c.removeEndpoint("Other/tcp@" + addr1)
+	if _, ok := c.serverConnPool["tcp@"+addr1]; ok || len(c.serverKeyList) != 1 {
+		t.Fatal("pool should be closed when no key references it")
+	}
+}
+
+func TestXClientRegisteredWeight(t *testing.T) {
+	d1, addr1 := startDelayedServer(t, 0)
+	d2, addr2 := startDelayedServer(t, 0)
+	d := NewMemoryDiscovery()
+	d.Set(&Endpoint{Key: "a", Instance: &registry.Instance{Network: "tcp", Addr: addr1, Weight: 3}})
+	d.Set(&Endpoint{Key: "b", Instance: &registry.Instance{Network: "tcp", Addr: addr2, Weight: 1}})
+	opt := testOption()
+	opt.LoadBalance = lb.WeightedRoundRobin
+	c, err := NewXClient(d, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	call := func(n int) {
+		for i := 0; i < n; i++ {
+			var reply int64
+			if err := c.Call(context.Background(), "Delayed", "Get", int64(1), &reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	call(40)
+	if d1.Calls() != 30 || d2.Calls() != 10 {
+		t.Fatalf("expect 30/10 by registered weight, got %d/%d", d1.Calls(), d2.Calls())
+	}
+	//注册信息更新后按新的权重选择
+	d.Set(&Endpoint{Key: "b", Instance: &registry.Instance{Network: "tcp", Addr: addr2, Weight: 3}})
+	waitFor(t, func() bool { return c.weight("tcp@"+addr2) == 3 })
+	call(40)
+	if d1.Calls() != 50 || d2.Calls() != 30 {
+		t.Fatalf("expect 20/20 after weight update, got %d/%d", d1.Calls()-30, d2.Calls()-10)
+	}
+}
+
+func TestXClientAddEndpointWhileDown(t *testing.T) {
+	addr1 := startTestServer(t)
+	addr2 := freeAddr(t)
+	d := NewMemoryDiscovery()
+	d.Set(&Endpoint{Key: "a", Instance: &registry.Instance{Network: "tcp", Addr: addr1}})
+	c, err := NewXClient(d, healthOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//建连失败的服务端保留并摘除,恢复后由探测重新加入
+	d.Set(&Endpoint{Key: "b", Instance: &registry.Instance{Network: "tcp", Addr: addr2}})
+	waitFor(t, func() bool {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		return c.ejected["tcp@"+addr2]
+	})
+	if n := activeCount(c, "Sleeper"); n != 1 || len(c.Instances()) != 2 {
+		t.Fatalf("expect server kept but ejected, active %d instances %d", n, len(c.Instances()))
+	}
+	serveOn(t, addr2)
+	waitFor(t, func() bool { return activeCount(c, "Sleeper") == 2 })
+
+	//未开启异常检测时按需重新建连
+	addr3 := freeAddr(t)
+	d = NewMemoryDiscovery()
+	c, err = NewXClient(d, testOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	d.Set(&Endpoint{Key: "c", Instance: &registry.Instance{Network: "tcp", Addr: addr3}})
+	waitFor(t, func() bool { return len(c.Instances()) == 1 })
+	serveOn(t, addr3)
+	var reply int64
+	if err = c.Call(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err != nil {
+		t.Fatal(err)
+	}
+}
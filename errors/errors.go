@@ -0,0 +1,183 @@
+// Package errors 定义跨网络传输的结构化错误,错误码随响应元数据返回给客户端
+package errors
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"github.com/arch3754/mrpc/util"
+	"strconv"
+)
+
+type Code uint32
+
+const (
+	OK Code = iota
+	Canceled
+	Unknown
+	InvalidArgument
+	DeadlineExceeded
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	Unimplemented
+	Internal
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+var codeNames = map[Code]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// 只比较错误码的哨兵错误,用于 errors.Is(err, ErrNotFound)
+var (
+	ErrCanceled           = &Error{Code: Canceled}
+	ErrUnknown            = &Error{Code: Unknown}
+	ErrInvalidArgument    = &Error{Code: InvalidArgument}
+	ErrDeadlineExceeded   = &Error{Code: DeadlineExceeded}
+	ErrNotFound           = &Error{Code: NotFound}
+	ErrAlreadyExists      = &Error{Code: AlreadyExists}
+	ErrPermissionDenied   = &Error{Code: PermissionDenied}
+	ErrResourceExhausted  = &Error{Code: ResourceExhausted}
+	ErrFailedPrecondition = &Error{Code: FailedPrecondition}
+	ErrAborted            = &Error{Code: Aborted}
+	ErrOutOfRange         = &Error{Code: OutOfRange}
+	ErrUnimplemented      = &Error{Code: Unimplemented}
+	ErrInternal           = &Error{Code: Internal}
+	ErrUnavailable        = &Error{Code: Unavailable}
+	ErrDataLoss           = &Error{Code: DataLoss}
+	ErrUnauthenticated    = &Error{Code: Unauthenticated}
+)
+
+// Error 带错误码的错误,Details 为可选的附加数据,原样传给客户端
+type Error struct {
+	Code    Code
+	Message string
+	Details []byte
+	cause   error
+}
+
+func New(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Wrap 用指定错误码包装 err,errors.Is/As 仍可匹配到 err
+func Wrap(code Code, err error) *Error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Message: err.Error(), cause: err}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is 错误码相同且 target 未指定 Message 或 Message 相同时匹配
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.Message == "" || t.Message == e.Message)
+}
+
+// WithDetails 返回附带 details 的副本
+func (e *Error) WithDetails(details []byte) *Error {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+// FromError 将任意错误转换为 *Error,错误链中已有 *Error 时沿用其错误码,err 为 nil 时返回 nil
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if stderrors.As(err, &e) {
+		if e == err {
+			return e
+		}
+		return &Error{Code: e.Code, Message: err.Error(), Details: e.Details, cause: err}
+	}
+	switch {
+	case stderrors.Is(err, context.DeadlineExceeded):
+		return Wrap(DeadlineExceeded, err)
+	case stderrors.Is(err, context.Canceled):
+		return Wrap(Canceled, err)
+	}
+	return Wrap(Unknown, err)
+}
+
+// CodeOf 返回 err 的错误码,nil 为 OK
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return FromError(err).Code
+}
+
+// SetMetadata 将错误编码进响应元数据
+func SetMetadata(meta map[string]string, err error) {
+	e := FromError(err)
+	if e == nil {
+		return
+	}
+	meta[util.ResponseError] = e.Message
+	meta[util.ResponseErrorCode] = strconv.FormatUint(uint64(e.Code), 10)
+	if len(e.Details) > 0 {
+		meta[util.ResponseErrorDetails] = string(e.Details)
+	}
+}
+
+// FromMetadata 从响应元数据还原错误,旧版本服务端未携带错误码时为 Unknown
+func FromMetadata(meta map[string]string) *Error {
+	e := &Error{Code: Unknown, Message: meta[util.ResponseError]}
+	if v, ok := meta[util.ResponseErrorCode]; ok {
+		if code, err := strconv.ParseUint(v, 10, 32); err == nil {
+			e.Code = Code(code)
+		}
+	}
+	if v, ok := meta[util.ResponseErrorDetails]; ok {
+		e.Details = []byte(v)
+	}
+	return e
+}
@@ -0,0 +1,59 @@
+package errors
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorIsAs(t *testing.T) {
+	base := New(NotFound, "service not found")
+	wrapped := fmt.Errorf("%w: A", base)
+	if !stderrors.Is(wrapped, ErrNotFound) {
+		t.Fatal("wrapped error should match ErrNotFound")
+	}
+	if stderrors.Is(wrapped, ErrInternal) {
+		t.Fatal("wrapped error should not match ErrInternal")
+	}
+	if !stderrors.Is(wrapped, base) {
+		t.Fatal("wrapped error should match its base")
+	}
+	var e *Error
+	if !stderrors.As(wrapped, &e) || e.Code != NotFound {
+		t.Fatalf("As failed: %v", e)
+	}
+	if CodeOf(wrapped) != NotFound || CodeOf(nil) != OK || CodeOf(fmt.Errorf("x")) != Unknown {
+		t.Fatal("CodeOf mismatch")
+	}
+}
+
+func TestFromContextError(t *testing.T) {
+	err := FromError(context.DeadlineExceeded)
+	if err.Code != DeadlineExceeded || !stderrors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected %v %v", err.Code, err)
+	}
+	if CodeOf(context.Canceled) != Canceled {
+		t.Fatal("expect Canceled")
+	}
+	if FromError(nil) != nil {
+		t.Fatal("expect nil")
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	meta := make(map[string]string)
+	SetMetadata(meta, fmt.Errorf("validate: %w", New(InvalidArgument, "bad name").WithDetails([]byte(`{"field":"name"}`))))
+	e := FromMetadata(meta)
+	if e.Code != InvalidArgument || e.Message != "validate: bad name" || string(e.Details) != `{"field":"name"}` {
+		t.Fatalf("unexpected %+v", e)
+	}
+	if !stderrors.Is(e, ErrInvalidArgument) {
+		t.Fatal("decoded error should match ErrInvalidArgument")
+	}
+
+	old := FromMetadata(map[string]string{"__response_error": "boom"})
+	if old.Code != Unknown || old.Message != "boom" {
+		t.Fatalf("unexpected %+v", old)
+	}
+}
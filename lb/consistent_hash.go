@@ -0,0 +1,132 @@
+package lb
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultVirtualNodes 每个服务端在哈希环上的虚拟节点数
+const DefaultVirtualNodes = 160
+
+type hashKey struct{}
+
+// WithHashKey 设置本次调用的路由 key,ConsistentHash 按 key 选择服务端
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKey 返回 ctx 中的路由 key
+func HashKey(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	key, ok := ctx.Value(hashKey{}).(string)
+	return key, ok
+}
+
+// ConsistentHashLoadBalancer 带虚拟节点的一致性哈希,相同 key 总是落到同一服务端,
+// 增删服务端时只有相邻区间的 key 重新映射,ctx 中没有 key 时按轮询选择
+type ConsistentHashLoadBalancer struct {
+	seq          uint64
+	VirtualNodes int
+	ring         atomic.Value
+}
+
+// hashRing 哈希环快照,UpdateAddrs 时整体替换
+type hashRing struct {
+	addrs  []string
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func NewConsistentHashLoadBalancer(virtualNodes int) *ConsistentHashLoadBalancer {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &ConsistentHashLoadBalancer{VirtualNodes: virtualNodes}
+}
+
+func (lb *ConsistentHashLoadBalancer) load() *hashRing {
+	r, _ := lb.ring.Load().(*hashRing)
+	if r == nil {
+		return &hashRing{}
+	}
+	return r
+}
+
+func (lb *ConsistentHashLoadBalancer) Get(ctx context.Context) (string, error) {
+	if key, ok := HashKey(ctx); ok {
+		return lb.Select(key)
+	}
+	r := lb.load()
+	if len(r.addrs) == 0 {
+		return "", ErrNoEndpoints
+	}
+	i := atomic.AddUint64(&lb.seq, 1) - 1
+	return r.addrs[i%uint64(len(r.addrs))], nil
+}
+
+// Select 返回 key 在哈希环上顺时针方向的第一个服务端
+func (lb *ConsistentHashLoadBalancer) Select(key string) (string, error) {
+	r := lb.load()
+	if len(r.hashes) == 0 {
+		return "", ErrNoEndpoints
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]], nil
+}
+
+// SelectN 返回 key 在哈希环上顺时针方向的前 n 个不同服务端,第一个与 Select 相同
+func (lb *ConsistentHashLoadBalancer) SelectN(key string, n int) []string {
+	r := lb.load()
+	if len(r.hashes) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.addrs) {
+		n = len(r.addrs)
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	addrs := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(r.hashes) && len(addrs) < n; i++ {
+		addr := r.nodes[r.hashes[(start+i)%len(r.hashes)]]
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (lb *ConsistentHashLoadBalancer) UpdateAddrs(addrs []string) {
+	vn := lb.VirtualNodes
+	if vn <= 0 {
+		vn = DefaultVirtualNodes
+	}
+	r := &hashRing{
+		addrs:  append([]string(nil), addrs...),
+		hashes: make([]uint32, 0, len(addrs)*vn),
+		nodes:  make(map[uint32]string, len(addrs)*vn),
+	}
+	for _, addr := range addrs {
+		for i := 0; i < vn; i++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			//哈希冲突时保留先加入的节点
+			if _, ok := r.nodes[h]; ok {
+				continue
+			}
+			r.nodes[h] = addr
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	lb.ring.Store(r)
+}
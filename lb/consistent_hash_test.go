@@ -0,0 +1,112 @@
+package lb
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestConsistentHashStable(t *testing.T) {
+	lb := NewConsistentHashLoadBalancer(0)
+	lb.UpdateAddrs([]string{"a", "b", "c"})
+	ctx := WithHashKey(context.Background(), "user-42")
+	want := mustGet(t, lb, ctx)
+	for i := 0; i < 100; i++ {
+		if got := mustGet(t, lb, ctx); got != want {
+			t.Fatalf("key routed to %v, then %v", want, got)
+		}
+	}
+	if got := mustSelect(t, lb, "user-42"); got != want {
+		t.Fatalf("Select %v differs from Get %v", got, want)
+	}
+}
+
+func TestConsistentHashDistribution(t *testing.T) {
+	lb := NewConsistentHashLoadBalancer(0)
+	addrs := []string{"10.0.0.1:8888", "10.0.0.2:8888", "10.0.0.3:8888", "10.0.0.4:8888"}
+	lb.UpdateAddrs(addrs)
+	counts := make(map[string]int)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		counts[mustSelect(t, lb, "key-"+strconv.Itoa(i))]++
+	}
+	for _, addr := range addrs {
+		if c := counts[addr]; c < n/len(addrs)/2 || c > n/len(addrs)*2 {
+			t.Fatalf("unbalanced distribution: %v", counts)
+		}
+	}
+}
+
+func TestConsistentHashMinimalRemap(t *testing.T) {
+	lb := NewConsistentHashLoadBalancer(0)
+	addrs := []string{"10.0.0.1:8888", "10.0.0.2:8888", "10.0.0.3:8888", "10.0.0.4:8888"}
+	lb.UpdateAddrs(addrs)
+	const n = 10000
+	before := make([]string, n)
+	for i := range before {
+		before[i] = mustSelect(t, lb, "key-"+strconv.Itoa(i))
+	}
+
+	lb.UpdateAddrs(append(addrs, "10.0.0.5:8888"))
+	moved := 0
+	for i := range before {
+		if after := mustSelect(t, lb, "key-"+strconv.Itoa(i)); after != before[i] {
+			if after != "10.0.0.5:8888" {
+				t.Fatalf("key moved between existing servers: %v -> %v", before[i], after)
+			}
+			moved++
+		}
+	}
+	//新增一个服务端时约 1/5 的 key 迁移
+	if moved > n*2/5 {
+		t.Fatalf("too many keys remapped: %d of %d", moved, n)
+	}
+
+	lb.UpdateAddrs(addrs[1:])
+	for i := range before {
+		if before[i] == addrs[0] {
+			continue
+		}
+		if after := mustSelect(t, lb, "key-"+strconv.Itoa(i)); after != before[i] {
+			t.Fatalf("removing %v remapped key from %v to %v", addrs[0], before[i], after)
+		}
+	}
+}
+
+func TestConsistentHashWithoutKey(t *testing.T) {
+	lb := NewConsistentHashLoadBalancer(0)
+	if _, err := lb.Get(context.Background()); err != ErrNoEndpoints {
+		t.Fatalf("expect ErrNoEndpoints, got %v", err)
+	}
+	if _, err := lb.Select("k"); err != ErrNoEndpoints {
+		t.Fatalf("expect ErrNoEndpoints, got %v", err)
+	}
+	lb.UpdateAddrs([]string{"a", "b"})
+	counts := countPicks(t, lb, 10)
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Fatalf("expect round robin without key, got %v", counts)
+	}
+}
+
+func TestConsistentHashSelectN(t *testing.T) {
+	lb := NewConsistentHashLoadBalancer(0)
+	lb.UpdateAddrs([]string{"a", "b", "c"})
+	addrs := lb.SelectN("user-42", 5)
+	if len(addrs) != 3 || addrs[0] != mustSelect(t, lb, "user-42") {
+		t.Fatalf("unexpected candidates %v", addrs)
+	}
+	if addrs[0] == addrs[1] || addrs[1] == addrs[2] || addrs[0] == addrs[2] {
+		t.Fatalf("expect distinct candidates, got %v", addrs)
+	}
+	//去掉首选服务端后 key 落到原来的第二个候选
+	var rest []string
+	for _, addr := range []string{"a", "b", "c"} {
+		if addr != addrs[0] {
+			rest = append(rest, addr)
+		}
+	}
+	lb.UpdateAddrs(rest)
+	if got := mustSelect(t, lb, "user-42"); got != addrs[1] {
+		t.Fatalf("expect %v after removing %v, got %v", addrs[1], addrs[0], got)
+	}
+}
@@ -0,0 +1,104 @@
+package lb
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// cpuWeightAlpha 新上报值在平滑权重中的占比
+	cpuWeightAlpha = 0.3
+	// minCpuWeight 空闲 CPU 为 0 的服务端仍保留少量流量,便于恢复后重新获得权重
+	minCpuWeight = 1.0
+)
+
+// CpuWeightLoadBalancer 按服务端心跳上报的空闲 CPU 百分比做平滑加权轮询,
+// 权重取上报值的指数移动平均,没有上报数据的服务端使用已知权重的平均值,都没有时等同于轮询
+type CpuWeightLoadBalancer struct {
+	addrs   addrList
+	mu      sync.Mutex
+	weights map[string]float64
+	current map[string]float64
+}
+
+func NewCpuWeightLoadBalancer() *CpuWeightLoadBalancer {
+	return &CpuWeightLoadBalancer{
+		weights: make(map[string]float64),
+		current: make(map[string]float64),
+	}
+}
+
+func (lb *CpuWeightLoadBalancer) Get(ctx context.Context) (string, error) {
+	addrs := lb.addrs.load()
+	if len(addrs) == 0 {
+		return "", ErrNoEndpoints
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	def := lb.defaultWeight(addrs)
+	var total float64
+	best := ""
+	for _, addr := range addrs {
+		w, ok := lb.weights[addr]
+		if !ok {
+			w = def
+		}
+		lb.current[addr] += w
+		total += w
+		if best == "" || lb.current[addr] > lb.current[best] {
+			best = addr
+		}
+	}
+	lb.current[best] -= total
+	return best, nil
+}
+
+// defaultWeight 已知权重的平均值
+func (lb *CpuWeightLoadBalancer) defaultWeight(addrs []string) float64 {
+	var sum float64
+	var n int
+	for _, addr := range addrs {
+		if w, ok := lb.weights[addr]; ok {
+			sum += w
+			n++
+		}
+	}
+	if n == 0 {
+		return minCpuWeight
+	}
+	return sum / float64(n)
+}
+
+func (lb *CpuWeightLoadBalancer) UpdateAddrs(addrs []string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.addrs.store(addrs)
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+	for addr := range lb.weights {
+		if !keep[addr] {
+			delete(lb.weights, addr)
+		}
+	}
+	for addr := range lb.current {
+		if !keep[addr] {
+			delete(lb.current, addr)
+		}
+	}
+}
+
+// UpdateWeight 更新服务端上报的空闲 CPU 百分比
+func (lb *CpuWeightLoadBalancer) UpdateWeight(addr string, idle float64) {
+	if idle < minCpuWeight {
+		idle = minCpuWeight
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if w, ok := lb.weights[addr]; ok {
+		lb.weights[addr] = w*(1-cpuWeightAlpha) + idle*cpuWeightAlpha
+	} else {
+		lb.weights[addr] = idle
+	}
+}
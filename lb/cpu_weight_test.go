@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestCpuWeightProportional(t *testing.T) {
+	lb := NewCpuWeightLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b"})
+	lb.UpdateWeight("a", 75)
+	lb.UpdateWeight("b", 25)
+	counts := countPicks(t, lb, 1000)
+	if counts["a"] != 750 || counts["b"] != 250 {
+		t.Fatalf("expect 750/250, got %v", counts)
+	}
+}
+
+func TestCpuWeightSmooth(t *testing.T) {
+	lb := NewCpuWeightLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b"})
+	lb.UpdateWeight("a", 50)
+	lb.UpdateWeight("b", 50)
+	//平滑加权轮询不会连续选中同一个权重相同的服务端
+	prev := ""
+	for i := 0; i < 10; i++ {
+		addr := mustGet(t, lb, context.Background())
+		if addr == prev {
+			t.Fatalf("picked %v twice in a row", addr)
+		}
+		prev = addr
+	}
+}
+
+func TestCpuWeightFallback(t *testing.T) {
+	lb := NewCpuWeightLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b", "c"})
+	counts := countPicks(t, lb, 300)
+	for _, addr := range []string{"a", "b", "c"} {
+		if counts[addr] != 100 {
+			t.Fatalf("expect round robin without data, got %v", counts)
+		}
+	}
+	//没有数据的服务端使用已知权重的平均值
+	lb.UpdateWeight("a", 80)
+	lb.UpdateWeight("b", 20)
+	counts = countPicks(t, lb, 1500)
+	if counts["c"] != 500 {
+		t.Fatalf("expect c to get average weight, got %v", counts)
+	}
+}
+
+func TestCpuWeightEWMA(t *testing.T) {
+	lb := NewCpuWeightLoadBalancer()
+	lb.UpdateAddrs([]string{"a"})
+	lb.UpdateWeight("a", 100)
+	lb.UpdateWeight("a", 0)
+	if w := lb.weights["a"]; math.Abs(w-(100*(1-cpuWeightAlpha)+minCpuWeight*cpuWeightAlpha)) > 1e-9 {
+		t.Fatalf("unexpected smoothed weight %v", w)
+	}
+	lb.UpdateAddrs(nil)
+	if _, err := lb.Get(context.Background()); len(lb.weights) != 0 || err != ErrNoEndpoints {
+		t.Fatal("expect weights dropped with addrs")
+	}
+}
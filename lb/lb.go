@@ -1,18 +1,94 @@
 package lb
 
+import (
+	"context"
+	"github.com/arch3754/mrpc/errors"
+	"sync/atomic"
+	"time"
+)
+
 const (
 	RoundRobin = iota
 	Random
 	CpuWeight
 	ConsistentHash
+	LeastRequest
+	P2C
+	WeightedRoundRobin
 )
 
+// ErrNoEndpoints 没有可选的服务端
+var ErrNoEndpoints = errors.New(errors.Unavailable, "mrpc: no endpoints available")
+
+// LoadBalancer 负载均衡,所有方法都可以被多个 goroutine 并发调用
 type LoadBalancer interface {
-	Get() string
+	// Get 选择本次调用的服务端,ctx 可携带路由信息,如 WithHashKey,没有服务端时返回 ErrNoEndpoints
+	Get(ctx context.Context) (string, error)
 	UpdateAddrs(addrs []string)
 }
 
-var LoadBalancerMap = map[int]LoadBalancer{
-	RoundRobin: &RoundRobinLoadBalancer{},
-	Random:     &RandomLoadBalancer{},
+// WeightedLoadBalancer 按服务端上报的权重选择的负载均衡
+type WeightedLoadBalancer interface {
+	LoadBalancer
+	UpdateWeight(addr string, weight float64)
+}
+
+// Feedback 接收每次调用的耗时与结果,用于按观测到的延迟调整选择
+type Feedback interface {
+	Feedback(addr string, latency time.Duration, err error)
+}
+
+// InFlightAware 需要服务端在途请求数的负载均衡,由客户端提供查询函数
+type InFlightAware interface {
+	SetInFlight(f func(addr string) int)
+}
+
+// WeightAware 按服务端注册权重选择的负载均衡,由客户端提供查询函数
+type WeightAware interface {
+	SetWeight(f func(addr string) int)
+}
+
+// HashSelector 按路由 key 选择的负载均衡,首选服务端熔断或已尝试过时依次选择哈希环上的下一个
+type HashSelector interface {
+	SelectN(key string, n int) []string
+}
+
+// LoadBalancerMap 负载均衡构造函数,每个客户端使用独立的实例
+var LoadBalancerMap = map[int]func() LoadBalancer{
+	RoundRobin:         func() LoadBalancer { return NewRoundRobinLoadBalancer() },
+	Random:             func() LoadBalancer { return NewRandomLoadBalancer() },
+	CpuWeight:          func() LoadBalancer { return NewCpuWeightLoadBalancer() },
+	ConsistentHash:     func() LoadBalancer { return NewConsistentHashLoadBalancer(DefaultVirtualNodes) },
+	LeastRequest:       func() LoadBalancer { return NewLeastRequestLoadBalancer() },
+	P2C:                func() LoadBalancer { return NewP2CLoadBalancer() },
+	WeightedRoundRobin: func() LoadBalancer { return NewWeightedRoundRobinLoadBalancer() },
+}
+
+// addrList 地址列表快照,UpdateAddrs 整体替换,Get 读取时无需加锁
+type addrList struct {
+	v atomic.Value
+}
+
+func (l *addrList) load() []string {
+	addrs, _ := l.v.Load().([]string)
+	return addrs
+}
+
+// store 复制 addrs,调用方之后修改原切片不影响快照
+func (l *addrList) store(addrs []string) {
+	l.v.Store(append([]string(nil), addrs...))
+}
+
+// inFlightFunc 原子替换的在途请求数查询函数
+type inFlightFunc struct {
+	v atomic.Value
+}
+
+func (f *inFlightFunc) load() func(addr string) int {
+	fn, _ := f.v.Load().(func(addr string) int)
+	return fn
+}
+
+func (f *inFlightFunc) store(fn func(addr string) int) {
+	f.v.Store(fn)
 }
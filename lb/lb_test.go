@@ -0,0 +1,139 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustGet(t *testing.T, lb LoadBalancer, ctx context.Context) string {
+	t.Helper()
+	addr, err := lb.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func mustSelect(t *testing.T, lb *ConsistentHashLoadBalancer, key string) string {
+	t.Helper()
+	addr, err := lb.Select(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func countPicks(t *testing.T, lb LoadBalancer, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[mustGet(t, lb, context.Background())]++
+	}
+	return counts
+}
+
+func TestNoEndpoints(t *testing.T) {
+	for typ, newLB := range LoadBalancerMap {
+		lb := newLB()
+		if _, err := lb.Get(context.Background()); err != ErrNoEndpoints {
+			t.Fatalf("lb %d: expect ErrNoEndpoints, got %v", typ, err)
+		}
+		lb.UpdateAddrs([]string{"a"})
+		lb.UpdateAddrs(nil)
+		if _, err := lb.Get(context.Background()); err != ErrNoEndpoints {
+			t.Fatalf("lb %d: expect ErrNoEndpoints after clearing addrs, got %v", typ, err)
+		}
+	}
+}
+
+func TestLoadBalancerMapIndependent(t *testing.T) {
+	a, b := LoadBalancerMap[RoundRobin](), LoadBalancerMap[RoundRobin]()
+	a.UpdateAddrs([]string{"a"})
+	if _, err := b.Get(context.Background()); err != ErrNoEndpoints {
+		t.Fatal("instances from LoadBalancerMap must not share state")
+	}
+}
+
+func TestUpdateAddrsCopies(t *testing.T) {
+	for typ, newLB := range LoadBalancerMap {
+		lb := newLB()
+		addrs := []string{"a", "b"}
+		lb.UpdateAddrs(addrs)
+		addrs[0], addrs[1] = "x", "y"
+		for i := 0; i < 10; i++ {
+			if addr := mustGet(t, lb, context.Background()); addr != "a" && addr != "b" {
+				t.Fatalf("lb %d: caller's slice leaked into balancer: %v", typ, addr)
+			}
+		}
+	}
+}
+
+// TestConcurrentStress 与 -race 一起运行,检查并发 Get/UpdateAddrs/反馈没有数据竞争
+func TestConcurrentStress(t *testing.T) {
+	lists := [][]string{
+		{"a", "b", "c"},
+		{"b", "c", "d", "e"},
+		{"e"},
+		{},
+	}
+	valid := map[string]bool{"a": true, "b": true, "c": true, "d": true, "e": true}
+	for typ, newLB := range LoadBalancerMap {
+		t.Run(fmt.Sprint(typ), func(t *testing.T) {
+			lb := newLB()
+			if a, ok := lb.(InFlightAware); ok {
+				a.SetInFlight(func(addr string) int { return len(addr) })
+			}
+			if a, ok := lb.(WeightAware); ok {
+				a.SetWeight(func(addr string) int { return len(addr) })
+			}
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					lb.UpdateAddrs(lists[i%len(lists)])
+					if w, ok := lb.(WeightedLoadBalancer); ok {
+						w.UpdateWeight("b", float64(i%100))
+					}
+				}
+			}()
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					ctx := context.Background()
+					if g%2 == 0 {
+						ctx = WithHashKey(ctx, fmt.Sprint("key-", g))
+					}
+					for i := 0; i < 2000; i++ {
+						addr, err := lb.Get(ctx)
+						if err != nil {
+							if err != ErrNoEndpoints {
+								t.Errorf("unexpected error %v", err)
+							}
+							continue
+						}
+						if !valid[addr] {
+							t.Errorf("unexpected addr %q", addr)
+						}
+						if fb, ok := lb.(Feedback); ok {
+							fb.Feedback(addr, time.Duration(i)*time.Microsecond, nil)
+						}
+					}
+				}(g)
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
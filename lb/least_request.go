@@ -0,0 +1,47 @@
+package lb
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// LeastRequestLoadBalancer 选择在途请求数最少的服务端,数量相同时轮流选择
+type LeastRequestLoadBalancer struct {
+	seq      uint64
+	addrs    addrList
+	inFlight inFlightFunc
+}
+
+func NewLeastRequestLoadBalancer() *LeastRequestLoadBalancer {
+	return &LeastRequestLoadBalancer{}
+}
+
+// SetInFlight 设置查询服务端在途请求数的函数
+func (lb *LeastRequestLoadBalancer) SetInFlight(f func(addr string) int) {
+	lb.inFlight.store(f)
+}
+
+func (lb *LeastRequestLoadBalancer) Get(ctx context.Context) (string, error) {
+	addrs := lb.addrs.load()
+	n := uint64(len(addrs))
+	if n == 0 {
+		return "", ErrNoEndpoints
+	}
+	start := (atomic.AddUint64(&lb.seq, 1) - 1) % n
+	inFlight := lb.inFlight.load()
+	if inFlight == nil {
+		return addrs[start], nil
+	}
+	best, min := "", 0
+	for i := uint64(0); i < n; i++ {
+		addr := addrs[(start+i)%n]
+		if load := inFlight(addr); best == "" || load < min {
+			best, min = addr, load
+		}
+	}
+	return best, nil
+}
+
+func (lb *LeastRequestLoadBalancer) UpdateAddrs(addrs []string) {
+	lb.addrs.store(addrs)
+}
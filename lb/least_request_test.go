@@ -0,0 +1,31 @@
+package lb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLeastRequest(t *testing.T) {
+	lb := NewLeastRequestLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b", "c"})
+	counts := countPicks(t, lb, 9)
+	if counts["a"] != 3 || counts["b"] != 3 || counts["c"] != 3 {
+		t.Fatalf("expect round robin without in-flight data, got %v", counts)
+	}
+
+	load := map[string]int{"a": 3, "b": 1, "c": 2}
+	lb.SetInFlight(func(addr string) int { return load[addr] })
+	for i := 0; i < 5; i++ {
+		if addr := mustGet(t, lb, context.Background()); addr != "b" {
+			t.Fatalf("expect least loaded b, got %v", addr)
+		}
+	}
+	//在途请求数相同时轮流选择
+	load["a"], load["c"] = 1, 1
+	counts = countPicks(t, lb, 30)
+	for _, addr := range []string{"a", "b", "c"} {
+		if counts[addr] == 0 {
+			t.Fatalf("ties should rotate, got %v", counts)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package lb
+
+import (
+	"context"
+	"github.com/valyala/fastrand"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// ewmaDecay 延迟 EWMA 的衰减时间常数,越久之前的样本权重越低
+	ewmaDecay = 10 * time.Second
+	// errorPenalty 失败调用按不低于该延迟计入 EWMA
+	errorPenalty = time.Second
+)
+
+// P2CLoadBalancer 随机取两个服务端,选择 EWMA 延迟乘以(在途请求数+1)较小的一个,
+// 没有样本的服务端得分为 0,会被优先探测
+type P2CLoadBalancer struct {
+	addrs    addrList
+	inFlight inFlightFunc
+	mu       sync.Mutex
+	stats    map[string]*ewma
+}
+
+type ewma struct {
+	value float64
+	last  time.Time
+}
+
+func NewP2CLoadBalancer() *P2CLoadBalancer {
+	return &P2CLoadBalancer{stats: make(map[string]*ewma)}
+}
+
+// SetInFlight 设置查询服务端在途请求数的函数
+func (lb *P2CLoadBalancer) SetInFlight(f func(addr string) int) {
+	lb.inFlight.store(f)
+}
+
+func (lb *P2CLoadBalancer) Get(ctx context.Context) (string, error) {
+	addrs := lb.addrs.load()
+	n := len(addrs)
+	switch n {
+	case 0:
+		return "", ErrNoEndpoints
+	case 1:
+		return addrs[0], nil
+	}
+	i := int(fastrand.Uint32n(uint32(n)))
+	j := int(fastrand.Uint32n(uint32(n - 1)))
+	if j >= i {
+		j++
+	}
+	a, b := addrs[i], addrs[j]
+	inFlight := lb.inFlight.load()
+	//在途请求数查询可能加锁,不在 lb.mu 内调用
+	scoreA, scoreB := lb.latency(a), lb.latency(b)
+	if inFlight != nil {
+		scoreA *= float64(inFlight(a) + 1)
+		scoreB *= float64(inFlight(b) + 1)
+	}
+	if scoreB < scoreA {
+		return b, nil
+	}
+	return a, nil
+}
+
+// latency 服务端的 EWMA 延迟,没有样本时为 0
+func (lb *P2CLoadBalancer) latency(addr string) float64 {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if s, ok := lb.stats[addr]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// Feedback 按调用耗时更新 EWMA,失败调用至少按 errorPenalty 计
+func (lb *P2CLoadBalancer) Feedback(addr string, latency time.Duration, err error) {
+	if err != nil && latency < errorPenalty {
+		latency = errorPenalty
+	}
+	now := time.Now()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	s, ok := lb.stats[addr]
+	if !ok {
+		lb.stats[addr] = &ewma{value: float64(latency), last: now}
+		return
+	}
+	w := math.Exp(-float64(now.Sub(s.last)) / float64(ewmaDecay))
+	s.value = s.value*w + float64(latency)*(1-w)
+	s.last = now
+}
+
+func (lb *P2CLoadBalancer) UpdateAddrs(addrs []string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.addrs.store(addrs)
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+	for addr := range lb.stats {
+		if !keep[addr] {
+			delete(lb.stats, addr)
+		}
+	}
+}
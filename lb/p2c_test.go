@@ -0,0 +1,65 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestP2CPrefersFast(t *testing.T) {
+	lb := NewP2CLoadBalancer()
+	lb.UpdateAddrs([]string{"fast", "slow"})
+	lb.Feedback("fast", time.Millisecond, nil)
+	lb.Feedback("slow", 100*time.Millisecond, nil)
+	//只有两个服务端时每次都比较两者
+	for i := 0; i < 20; i++ {
+		if addr := mustGet(t, lb, context.Background()); addr != "fast" {
+			t.Fatalf("expect fast, got %v", addr)
+		}
+	}
+}
+
+func TestP2CErrorPenalty(t *testing.T) {
+	lb := NewP2CLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b"})
+	lb.Feedback("a", 10*time.Millisecond, nil)
+	lb.Feedback("b", time.Millisecond, errors.New("boom"))
+	if addr := mustGet(t, lb, context.Background()); addr != "a" {
+		t.Fatalf("failing server should be penalized, got %v", addr)
+	}
+}
+
+func TestP2CInFlight(t *testing.T) {
+	lb := NewP2CLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b"})
+	lb.Feedback("a", 10*time.Millisecond, nil)
+	lb.Feedback("b", 10*time.Millisecond, nil)
+	lb.SetInFlight(func(addr string) int {
+		if addr == "a" {
+			return 5
+		}
+		return 0
+	})
+	if addr := mustGet(t, lb, context.Background()); addr != "b" {
+		t.Fatalf("expect less loaded b, got %v", addr)
+	}
+}
+
+func TestP2CNewAddrProbed(t *testing.T) {
+	lb := NewP2CLoadBalancer()
+	lb.UpdateAddrs([]string{"old"})
+	lb.Feedback("old", 10*time.Millisecond, nil)
+	lb.UpdateAddrs([]string{"old", "new"})
+	if addr := mustGet(t, lb, context.Background()); addr != "new" {
+		t.Fatalf("expect new server without samples to be probed, got %v", addr)
+	}
+	lb.UpdateAddrs([]string{"new"})
+	if _, ok := lb.stats["old"]; ok {
+		t.Fatal("expect stats of removed server dropped")
+	}
+	counts := countPicks(t, lb, 3)
+	if counts["new"] != 3 {
+		t.Fatalf("expect single server, got %v", counts)
+	}
+}
@@ -1,15 +1,25 @@
 package lb
 
-import "github.com/valyala/fastrand"
+import (
+	"context"
+	"github.com/valyala/fastrand"
+)
 
 type RandomLoadBalancer struct {
-	Addrs []string
+	addrs addrList
 }
 
-func (lb *RandomLoadBalancer) Get() string {
-	return lb.Addrs[fastrand.Uint32n(uint32(len(lb.Addrs)))]
+func NewRandomLoadBalancer() *RandomLoadBalancer {
+	return &RandomLoadBalancer{}
+}
 
+func (lb *RandomLoadBalancer) Get(ctx context.Context) (string, error) {
+	addrs := lb.addrs.load()
+	if len(addrs) == 0 {
+		return "", ErrNoEndpoints
+	}
+	return addrs[fastrand.Uint32n(uint32(len(addrs)))], nil
 }
 func (lb *RandomLoadBalancer) UpdateAddrs(addrs []string) {
-	lb.Addrs = addrs[:]
-}
\ No newline at end of file
+	lb.addrs.store(addrs)
+}
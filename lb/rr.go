@@ -1,16 +1,27 @@
 package lb
 
+import (
+	"context"
+	"sync/atomic"
+)
+
 type RoundRobinLoadBalancer struct {
-	Addrs []string
-	seq   int
+	seq   uint64
+	addrs addrList
 }
 
-func (lb *RoundRobinLoadBalancer) Get() string {
-	i := lb.seq % len(lb.Addrs)
-	lb.seq = i + 1
+func NewRoundRobinLoadBalancer() *RoundRobinLoadBalancer {
+	return &RoundRobinLoadBalancer{}
+}
 
-	return lb.Addrs[i]
+func (lb *RoundRobinLoadBalancer) Get(ctx context.Context) (string, error) {
+	addrs := lb.addrs.load()
+	if len(addrs) == 0 {
+		return "", ErrNoEndpoints
+	}
+	i := atomic.AddUint64(&lb.seq, 1) - 1
+	return addrs[i%uint64(len(addrs))], nil
 }
 func (lb *RoundRobinLoadBalancer) UpdateAddrs(addrs []string) {
-	lb.Addrs = addrs
+	lb.addrs.store(addrs)
 }
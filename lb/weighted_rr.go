@@ -0,0 +1,88 @@
+package lb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultStaticWeight 未设置权重的服务端使用的权重
+const defaultStaticWeight = 1
+
+// WeightedRoundRobinLoadBalancer 按服务端注册的权重(registry.Instance.Weight)做平滑加权轮询,
+// 权重由客户端通过 SetWeight 提供,未设置权重(<=0)的服务端权重为 1
+type WeightedRoundRobinLoadBalancer struct {
+	addrs   addrList
+	weight  weightFunc
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func NewWeightedRoundRobinLoadBalancer() *WeightedRoundRobinLoadBalancer {
+	return &WeightedRoundRobinLoadBalancer{current: make(map[string]int)}
+}
+
+// SetWeight 设置查询服务端注册权重的函数
+func (lb *WeightedRoundRobinLoadBalancer) SetWeight(f func(addr string) int) {
+	lb.weight.store(f)
+}
+
+func (lb *WeightedRoundRobinLoadBalancer) Get(ctx context.Context) (string, error) {
+	addrs := lb.addrs.load()
+	if len(addrs) == 0 {
+		return "", ErrNoEndpoints
+	}
+	//权重查询可能加锁,不在 lb.mu 内调用
+	weights := make([]int, len(addrs))
+	weight := lb.weight.load()
+	for i, addr := range addrs {
+		weights[i] = defaultStaticWeight
+		if weight != nil {
+			if v := weight(addr); v > 0 {
+				weights[i] = v
+			}
+		}
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	total := 0
+	best := ""
+	for i, addr := range addrs {
+		lb.current[addr] += weights[i]
+		total += weights[i]
+		if best == "" || lb.current[addr] > lb.current[best] {
+			best = addr
+		}
+	}
+	lb.current[best] -= total
+	return best, nil
+}
+
+func (lb *WeightedRoundRobinLoadBalancer) UpdateAddrs(addrs []string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.addrs.store(addrs)
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+	for addr := range lb.current {
+		if !keep[addr] {
+			delete(lb.current, addr)
+		}
+	}
+}
+
+// weightFunc 原子替换的权重查询函数
+type weightFunc struct {
+	v atomic.Value
+}
+
+func (f *weightFunc) load() func(addr string) int {
+	fn, _ := f.v.Load().(func(addr string) int)
+	return fn
+}
+
+func (f *weightFunc) store(fn func(addr string) int) {
+	f.v.Store(fn)
+}
@@ -0,0 +1,95 @@
+package lb
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWeightedRoundRobinProportional(t *testing.T) {
+	lb := NewWeightedRoundRobinLoadBalancer()
+	weights := map[string]int{"a": 3, "b": 1}
+	lb.SetWeight(func(addr string) int { return weights[addr] })
+	lb.UpdateAddrs([]string{"a", "b"})
+	counts := countPicks(t, lb, 400)
+	if counts["a"] != 300 || counts["b"] != 100 {
+		t.Fatalf("expect 300/100, got %v", counts)
+	}
+}
+
+func TestWeightedRoundRobinDefaultWeight(t *testing.T) {
+	lb := NewWeightedRoundRobinLoadBalancer()
+	lb.UpdateAddrs([]string{"a", "b"})
+	//没有权重时等同于轮询
+	if counts := countPicks(t, lb, 100); counts["a"] != 50 || counts["b"] != 50 {
+		t.Fatalf("expect round robin without weights, got %v", counts)
+	}
+	//未设置权重的服务端权重为 1
+	lb.SetWeight(func(addr string) int {
+		if addr == "a" {
+			return 4
+		}
+		return 0
+	})
+	if counts := countPicks(t, lb, 500); counts["a"] != 400 || counts["b"] != 100 {
+		t.Fatalf("expect 400/100, got %v", counts)
+	}
+}
+
+func TestWeightedRoundRobinSmooth(t *testing.T) {
+	lb := NewWeightedRoundRobinLoadBalancer()
+	lb.SetWeight(func(addr string) int { return map[string]int{"a": 5, "b": 1, "c": 1}[addr] })
+	lb.UpdateAddrs([]string{"a", "b", "c"})
+	//平滑加权轮询把低权重的服务端分散在高权重的服务端之间
+	var seq string
+	for i := 0; i < 7; i++ {
+		seq += mustGet(t, lb, context.Background())
+	}
+	if seq != "aabacaa" {
+		t.Fatalf("unexpected sequence %v", seq)
+	}
+}
+
+func TestWeightedRoundRobinConcurrentUpdate(t *testing.T) {
+	lb := NewWeightedRoundRobinLoadBalancer()
+	//与客户端相同:查询权重时加读锁,持有写锁时更新地址
+	var mu sync.RWMutex
+	lb.SetWeight(func(addr string) int {
+		runtime.Gosched()
+		mu.RLock()
+		defer mu.RUnlock()
+		return 2
+	})
+	lb.UpdateAddrs([]string{"a", "b"})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				_, _ = lb.Get(context.Background())
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10000; j++ {
+			mu.Lock()
+			lb.UpdateAddrs([]string{"a", "b", "c"}[:2+j%2])
+			mu.Unlock()
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Get and UpdateAddrs deadlocked")
+	}
+}
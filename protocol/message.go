@@ -8,6 +8,13 @@ import (
 	"io"
 )
 
+var (
+	// ErrUnsupportedCompress 消息头中的压缩方式不支持,此时消息帧已完整读取,Payload 保持原样
+	ErrUnsupportedCompress = errors.New("mrpc: unsupported compress type")
+	// ErrMalformedMessage 消息帧长度字段与内容不符
+	ErrMalformedMessage = errors.New("mrpc: malformed message")
+)
+
 type Header [14]byte
 
 func (h *Header) Version() byte {
@@ -22,8 +29,23 @@ type MessageType byte
 const (
 	Request MessageType = iota
 	Response
+	// StreamOpen 打开流,Seq 为流 ID,Path/Method 指定服务方法
+	StreamOpen
+	// StreamData 流上的一条消息
+	StreamData
+	// StreamHalfClose 发送方不再发送数据,服务端发出时 Status/Metadata 携带流的最终结果
+	StreamHalfClose
+	// StreamCancel 取消流
+	StreamCancel
+	// StreamWindowUpdate 接收方归还发送窗口,Payload 为 4 字节大端增量
+	StreamWindowUpdate
 )
 
+// IsStream 是否为流相关的消息
+func (t MessageType) IsStream() bool {
+	return t >= StreamOpen && t <= StreamWindowUpdate
+}
+
 func (h *Header) MessageType() MessageType {
 	return MessageType(h[1])
 }
@@ -116,6 +138,9 @@ func (m *Message) Clone() *Message {
 	header.SetCompress(None)
 	c.Header = &header
 	c.Path = m.Path
+	c.Method = m.Method
+	c.Metadata = nil
+	c.Payload = nil
 	return c
 }
 
@@ -140,6 +165,9 @@ func decodeMetadata(l uint32, data []byte) (map[string]string, error) {
 	m := make(map[string]string)
 	n := uint32(0)
 	for n < l {
+		if n+4 > l {
+			return m, errors.New("metadata miss key/value")
+		}
 		sl := binary.BigEndian.Uint32(data[n : n+4])
 		n = n + 4
 		if n+sl > l-4 {
@@ -164,8 +192,10 @@ func (m *Message) Encode() *[]byte {
 	metaSize := len(meta)
 	payload := m.Payload
 	if m.Compress() != None {
-		compress := Compressors[m.Compress()]
-		if gzipPayload, err := compress.Zip(payload); err != nil {
+		compress, ok := Compressors[m.Compress()]
+		if !ok {
+			m.SetCompress(None)
+		} else if gzipPayload, err := compress.Zip(payload); err != nil {
 			m.SetCompress(None)
 		} else {
 			payload = gzipPayload
@@ -228,16 +258,32 @@ func (m *Message) Decode(r io.Reader) error {
 		return err
 	}
 	var n uint32
-	pathSize := binary.BigEndian.Uint32(data[n : n+4])
-	n = n + 4
+	//每段都是 4 字节长度 + 内容,长度越界说明帧已损坏
+	next := func() (uint32, bool) {
+		if uint64(n)+4 > uint64(totalSize) {
+			return 0, false
+		}
+		l := binary.BigEndian.Uint32(data[n : n+4])
+		n = n + 4
+		return l, uint64(n)+uint64(l) <= uint64(totalSize)
+	}
+	pathSize, ok := next()
+	if !ok {
+		return ErrMalformedMessage
+	}
 	m.Path = string(data[n : n+pathSize])
 	n = n + pathSize
-	methodSize := binary.BigEndian.Uint32(data[n : n+4])
-	n = n + 4
+	methodSize, ok := next()
+	if !ok {
+		return ErrMalformedMessage
+	}
 	m.Method = string(data[n : n+methodSize])
 	n = n + methodSize
-	metaSize := binary.BigEndian.Uint32(data[n : n+4])
-	n = n + 4
+	metaSize, ok := next()
+	if !ok {
+		return ErrMalformedMessage
+	}
+	m.Metadata = nil
 	if metaSize > 0 {
 		m.Metadata, err = decodeMetadata(metaSize, data[n:n+metaSize])
 		if err != nil {
@@ -248,9 +294,15 @@ func (m *Message) Decode(r io.Reader) error {
 
 	//payloadSize
 	//payloadSize := binary.BigEndian.Uint32(data[n : n+4])
-	m.Payload = data[n+4:]
+	if _, ok = next(); !ok {
+		return ErrMalformedMessage
+	}
+	m.Payload = data[n:]
 	if m.Compress() != None {
-		compress := Compressors[m.Compress()]
+		compress, ok := Compressors[m.Compress()]
+		if !ok {
+			return ErrUnsupportedCompress
+		}
 		m.Payload, err = compress.Unzip(m.Payload)
 		if err != nil {
 			return err
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 )
 
@@ -32,3 +33,28 @@ func TestNewMessage(t *testing.T) {
 	t.Log(m.Metadata)
 	t.Log(string(m.Payload))
 }
+
+func TestDecodeMalformed(t *testing.T) {
+	msg := NewMessage()
+	msg.Path = "test"
+	msg.Method = "me"
+	msg.Payload = []byte("payload")
+	body := *msg.Encode()
+
+	//把 path 长度改成超出整帧
+	broken := append([]byte{}, body...)
+	binary.BigEndian.PutUint32(broken[18:22], 1<<20)
+	if err := NewMessage().Decode(bytes.NewBuffer(broken)); err != ErrMalformedMessage {
+		t.Fatalf("expect ErrMalformedMessage, got %v", err)
+	}
+
+	unknown := append([]byte{}, body...)
+	unknown[3] = 99
+	m := NewMessage()
+	if err := m.Decode(bytes.NewBuffer(unknown)); err != ErrUnsupportedCompress {
+		t.Fatalf("expect ErrUnsupportedCompress, got %v", err)
+	}
+	if m.Path != "test" || string(m.Payload) != "payload" {
+		t.Fatalf("frame should be fully read, got path=%v payload=%s", m.Path, m.Payload)
+	}
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+)
+
+// DefaultStreamWindow 每个流初始的发送窗口(字节),两端一致
+const DefaultStreamWindow = 64 * 1024
+
+// NewStreamMessage 构造流消息,控制帧不压缩
+func NewStreamMessage(typ MessageType, seq uint64) *Message {
+	msg := NewMessage()
+	msg.SetMessageType(typ)
+	msg.SetSeq(seq)
+	return msg
+}
+
+// NewWindowUpdate 构造归还 n 字节窗口的 StreamWindowUpdate 消息
+func NewWindowUpdate(seq uint64, n uint32) *Message {
+	msg := NewStreamMessage(StreamWindowUpdate, seq)
+	msg.Payload = make([]byte, 4)
+	binary.BigEndian.PutUint32(msg.Payload, n)
+	return msg
+}
+
+// WindowUpdateSize 解析 StreamWindowUpdate 的增量
+func WindowUpdateSize(msg *Message) uint32 {
+	if len(msg.Payload) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(msg.Payload)
+}
+
+// SendWindow 流的发送窗口,窗口耗尽时 Acquire 阻塞直到对端归还,保证单个流不会占满连接
+type SendWindow struct {
+	mu     sync.Mutex
+	avail  int64
+	err    error
+	notify chan struct{}
+}
+
+func NewSendWindow(size int64) *SendWindow {
+	return &SendWindow{avail: size, notify: make(chan struct{}, 1)}
+}
+
+// Acquire 等待窗口可用后扣减 n,窗口只要大于 0 即可发送,允许单条消息超出窗口
+func (w *SendWindow) Acquire(ctx context.Context, n int) error {
+	for {
+		w.mu.Lock()
+		if w.err != nil {
+			w.mu.Unlock()
+			return w.err
+		}
+		if w.avail > 0 {
+			w.avail -= int64(n)
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release 归还 n 字节窗口
+func (w *SendWindow) Release(n int64) {
+	w.mu.Lock()
+	w.avail += n
+	w.mu.Unlock()
+	w.wake()
+}
+
+// Close 关闭窗口,之后 Acquire 返回 err
+func (w *SendWindow) Close(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.wake()
+}
+
+func (w *SendWindow) wake() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// RecvBuffer 流的接收缓冲,对端遵守窗口时其大小不超过窗口加一条消息,读连接的协程不会被阻塞
+type RecvBuffer struct {
+	mu       sync.Mutex
+	queue    [][]byte
+	err      error
+	window   int64
+	consumed int64
+	notify   chan struct{}
+}
+
+func NewRecvBuffer(window int64) *RecvBuffer {
+	return &RecvBuffer{window: window, notify: make(chan struct{}, 1)}
+}
+
+// Push 追加一条消息,缓冲关闭后丢弃
+func (b *RecvBuffer) Push(payload []byte) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.queue = append(b.queue, payload)
+	}
+	b.mu.Unlock()
+	b.wake()
+}
+
+// CloseWithError 已缓冲的消息读完后 Pop 返回 err,正常结束为 io.EOF
+func (b *RecvBuffer) CloseWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.wake()
+}
+
+// Pop 取出一条消息,update 大于 0 时调用方需向对端发送等量的 StreamWindowUpdate
+func (b *RecvBuffer) Pop(ctx context.Context) (payload []byte, update uint32, err error) {
+	for {
+		b.mu.Lock()
+		if len(b.queue) > 0 {
+			payload = b.queue[0]
+			b.queue[0] = nil
+			b.queue = b.queue[1:]
+			b.consumed += int64(len(payload))
+			//消费过半窗口后一次性归还,减少控制帧
+			if b.err == nil && b.consumed >= b.window/2 {
+				update = uint32(b.consumed)
+				b.consumed = 0
+			}
+			b.mu.Unlock()
+			return payload, update, nil
+		}
+		if b.err != nil {
+			err = b.err
+			b.mu.Unlock()
+			return nil, 0, err
+		}
+		b.mu.Unlock()
+		select {
+		case <-b.notify:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+func (b *RecvBuffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/arch3754/mrpc/protocol"
+	"net"
+	"strings"
+)
+
+// Instance 注册中心中服务端实例的注册信息,以 JSON 保存
+type Instance struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	//Weight 实例权重,0 表示未设置,客户端使用 lb.WeightedRoundRobin 时按权重选择
+	Weight  int                  `json:"weight,omitempty"`
+	Version string               `json:"version,omitempty"`
+	Zone    string               `json:"zone,omitempty"`
+	Tags    []string             `json:"tags,omitempty"`
+	Codecs  []protocol.Serialize `json:"codecs,omitempty"`
+	//Services 实例上注册的服务名
+	Services []string `json:"services,omitempty"`
+}
+
+// Key 实例标识,格式为 network@addr
+func (i *Instance) Key() string {
+	return i.Network + "@" + i.Addr
+}
+
+// HasTag 实例是否带有 tag
+func (i *Instance) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsCodec 实例是否支持序列化方式 s,未声明 Codecs 时视为支持
+func (i *Instance) SupportsCodec(s protocol.Serialize) bool {
+	if len(i.Codecs) == 0 {
+		return true
+	}
+	for _, c := range i.Codecs {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HasService 实例是否注册了服务 name,未声明 Services 时视为提供所有服务
+func (i *Instance) HasService(name string) bool {
+	if len(i.Services) == 0 {
+		return true
+	}
+	for _, s := range i.Services {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Instance) Marshal() (string, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Validate 检查注册信息是否完整,tcp/udp 地址需为 host:port
+func (i *Instance) Validate() error {
+	if len(i.Network) == 0 || len(i.Addr) == 0 {
+		return fmt.Errorf("instance invalid: network and addr are required")
+	}
+	if i.Weight < 0 {
+		return fmt.Errorf("instance invalid: negative weight %d", i.Weight)
+	}
+	if strings.HasPrefix(i.Network, "tcp") || strings.HasPrefix(i.Network, "udp") {
+		if _, port, err := net.SplitHostPort(i.Addr); err != nil || len(port) == 0 {
+			return fmt.Errorf("instance invalid: address %q is not host:port", i.Addr)
+		}
+	}
+	return nil
+}
+
+// ParseAddress 解析 network@addr 格式的地址
+func ParseAddress(s string) (network, addr string, err error) {
+	arr := strings.SplitN(s, "@", 2)
+	if len(arr) != 2 || len(arr[0]) == 0 || len(arr[1]) == 0 {
+		return "", "", fmt.Errorf("address parse failed: %q", s)
+	}
+	return arr[0], arr[1], nil
+}
+
+// ParseInstance 解析注册信息,兼容旧版只保存 network@addr 的值
+func ParseInstance(val string) (*Instance, error) {
+	val = strings.TrimSpace(val)
+	if strings.HasPrefix(val, "{") {
+		inst := &Instance{}
+		if err := json.Unmarshal([]byte(val), inst); err != nil {
+			return nil, fmt.Errorf("instance parse failed: %v", err)
+		}
+		if len(inst.Network) == 0 || len(inst.Addr) == 0 {
+			return nil, fmt.Errorf("instance parse failed: network and addr are required")
+		}
+		return inst, nil
+	}
+	network, addr, err := ParseAddress(val)
+	if err != nil {
+		return nil, err
+	}
+	return &Instance{Network: network, Addr: addr}, nil
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"github.com/arch3754/mrpc/protocol"
+	"reflect"
+	"testing"
+)
+
+func TestInstanceRoundTrip(t *testing.T) {
+	inst := &Instance{
+		Network:  "tcp",
+		Addr:     "10.0.0.1:8888",
+		Weight:   10,
+		Version:  "v1.2.0",
+		Zone:     "sh-a",
+		Tags:     []string{"canary"},
+		Codecs:   []protocol.Serialize{protocol.Json, protocol.MsgPack},
+		Services: []string{"A", "B"},
+	}
+	val, err := inst.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseInstance(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inst, got) {
+		t.Fatalf("expect %+v, got %+v", inst, got)
+	}
+	if got.Key() != "tcp@10.0.0.1:8888" {
+		t.Fatalf("unexpected key %v", got.Key())
+	}
+	if !got.HasTag("canary") || got.HasTag("stable") {
+		t.Fatal("unexpected tag match")
+	}
+	if !got.HasService("A") || got.HasService("C") {
+		t.Fatal("unexpected service match")
+	}
+}
+
+func TestParseLegacyInstance(t *testing.T) {
+	inst, err := ParseInstance("tcp@127.0.0.1:8888")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Network != "tcp" || inst.Addr != "127.0.0.1:8888" {
+		t.Fatalf("unexpected instance %+v", inst)
+	}
+	//旧版注册信息没有声明时不做限制
+	if !inst.SupportsCodec(protocol.MsgPack) || !inst.HasService("A") {
+		t.Fatal("legacy instance should accept any codec and service")
+	}
+}
+
+func TestParseInstanceInvalid(t *testing.T) {
+	for _, val := range []string{
+		"",
+		"127.0.0.1:8888",
+		"tcp@",
+		"{not json",
+		`{"network":"tcp"}`,
+	} {
+		if _, err := ParseInstance(val); err == nil {
+			t.Fatalf("expect error for %q", val)
+		}
+	}
+}
+
+func TestInstanceValidate(t *testing.T) {
+	for _, inst := range []*Instance{
+		{Network: "tcp", Addr: "127.0.0.1:8888", Weight: 3},
+		{Network: "tcp", Addr: ":8888"},
+		{Network: "unix", Addr: "/tmp/mrpc.sock"},
+	} {
+		if err := inst.Validate(); err != nil {
+			t.Fatalf("unexpected error for %+v: %v", inst, err)
+		}
+	}
+	for _, inst := range []*Instance{
+		{Network: "tcp"},
+		{Addr: "127.0.0.1:8888"},
+		{Network: "tcp", Addr: "127.0.0.1"},
+		{Network: "tcp", Addr: "127.0.0.1:"},
+		{Network: "tcp", Addr: "127.0.0.1:8888", Weight: -1},
+	} {
+		if err := inst.Validate(); err == nil {
+			t.Fatalf("expect error for %+v", inst)
+		}
+	}
+}
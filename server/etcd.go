@@ -2,22 +2,53 @@ package server
 
 import (
 	"context"
+	"errors"
+	"github.com/arch3754/mrpc/codec"
 	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/protocol"
+	"github.com/arch3754/mrpc/registry"
 	"github.com/arch3754/mrpc/util"
 	"go.etcd.io/etcd/clientv3"
+	"sort"
+	"sync"
+	"time"
 )
 
+const (
+	//租约丢失后重新注册的退避时间
+	reRegisterBaseDelay = 500 * time.Millisecond
+	reRegisterMaxDelay  = 30 * time.Second
+	//revokeTimeout 撤销注册失败的租约的超时时间
+	revokeTimeout = 5 * time.Second
+)
+
+// errNoService 没有 Register 任何服务时无法写入注册信息
+var errNoService = errors.New("mrpc: etcd plugin has no service to register")
+
 type EtcdPlugin struct {
 	client        *clientv3.Client
-	leaseID       clientv3.LeaseID //租约ID
+	leaseID       clientv3.LeaseID //租约ID,租约丢失后为 0
 	config        *EtcdConfig
 	keepAliveChan <-chan *clientv3.LeaseKeepAliveResponse
+	mu            sync.Mutex
+	services      []string
+	//ctx Close 时取消,结束续租与重新注册
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 type EtcdConfig struct {
 	BasePath      string
 	Lease         int64
 	RpcServerAddr string
 	EtcdConf      *clientv3.Config
+	//Weight Version Zone Tags 写入注册信息,供客户端负载均衡与路由使用
+	Weight  int
+	Version string
+	Zone    string
+	Tags    []string
+	//LegacyLayout 按旧格式注册,key 为 BasePath/<RpcServerAddr>,值为 RpcServerAddr,
+	//不含服务名与实例信息。滚动升级期间仍有旧版本客户端时开启,客户端全部升级后关闭
+	LegacyLayout bool
 }
 
 func NewEtcdPlugin(cfg *EtcdConfig) (Plugin, error) {
@@ -32,47 +63,205 @@ func NewEtcdPlugin(cfg *EtcdConfig) (Plugin, error) {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &EtcdPlugin{
 		config: cfg,
 		client: c,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Register 记录服务名,已注册到 etcd 时更新注册信息
+func (p *EtcdPlugin) Register(name string, methods []string) error {
+	p.mu.Lock()
+	for _, s := range p.services {
+		if s == name {
+			p.mu.Unlock()
+			return nil
+		}
+	}
+	p.services = append(p.services, name)
+	leaseID := p.leaseID
+	p.mu.Unlock()
+	if leaseID == 0 {
+		return nil
+	}
+	return p.put(leaseID)
+}
+
+// instance 当前实例的注册信息
+func (p *EtcdPlugin) instance() (*registry.Instance, error) {
+	network, addr, err := registry.ParseAddress(p.config.RpcServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	codecs := make([]protocol.Serialize, 0, len(codec.CodecMap))
+	for s := range codec.CodecMap {
+		codecs = append(codecs, s)
+	}
+	sort.Slice(codecs, func(i, j int) bool { return codecs[i] < codecs[j] })
+	p.mu.Lock()
+	services := append([]string(nil), p.services...)
+	p.mu.Unlock()
+	sort.Strings(services)
+	return &registry.Instance{
+		Network:  network,
+		Addr:     addr,
+		Weight:   p.config.Weight,
+		Version:  p.config.Version,
+		Zone:     p.config.Zone,
+		Tags:     p.config.Tags,
+		Codecs:   codecs,
+		Services: services,
 	}, nil
 }
 
+// key 服务 service 的注册 key,格式为 BasePath/<service>/<RpcServerAddr>
+func (p *EtcdPlugin) key(service string) string {
+	return p.config.BasePath + "/" + service + "/" + p.config.RpcServerAddr
+}
+
+// legacyKey 旧格式的注册 key
+func (p *EtcdPlugin) legacyKey() string {
+	return p.config.BasePath + "/" + p.config.RpcServerAddr
+}
+
+// ops 注册信息的写入操作,均绑定租约,注销时随租约撤销一起删除
+func (p *EtcdPlugin) ops(leaseID clientv3.LeaseID) ([]clientv3.Op, error) {
+	if p.config.LegacyLayout {
+		return []clientv3.Op{clientv3.OpPut(p.legacyKey(), p.config.RpcServerAddr, clientv3.WithLease(leaseID))}, nil
+	}
+	inst, err := p.instance()
+	if err != nil {
+		return nil, err
+	}
+	val, err := inst.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]clientv3.Op, 0, len(inst.Services))
+	for _, s := range inst.Services {
+		ops = append(ops, clientv3.OpPut(p.key(s), val, clientv3.WithLease(leaseID)))
+	}
+	return ops, nil
+}
+
+// put 写入注册信息并绑定租约
+func (p *EtcdPlugin) put(leaseID clientv3.LeaseID) error {
+	ops, err := p.ops(leaseID)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.Txn(context.Background()).Then(ops...).Commit()
+	return err
+}
+
+// ServiceRegister 注册到 etcd,没有可注册的服务时返回错误
 func (p *EtcdPlugin) ServiceRegister() error {
+	p.mu.Lock()
+	n := len(p.services)
+	p.mu.Unlock()
+	if n == 0 && !p.config.LegacyLayout {
+		return errNoService
+	}
+	if err := p.register(); err != nil {
+		return err
+	}
+	go p.listenLeaseRespChan()
+	return nil
+}
+
+// register 申请租约,写入注册信息并续租
+func (p *EtcdPlugin) register() error {
 	//设置租约时间
-	resp, err := p.client.Grant(context.Background(), p.config.Lease)
+	resp, err := p.client.Grant(p.ctx, p.config.Lease)
 	if err != nil {
 		return err
 	}
 	//注册服务并绑定租约
-	_, err = p.client.Put(context.Background(), p.config.BasePath+"/"+p.config.RpcServerAddr, p.config.RpcServerAddr, clientv3.WithLease(resp.ID))
-	if err != nil {
+	if err = p.put(resp.ID); err != nil {
+		p.revoke(resp.ID)
 		return err
 	}
 	//设置续租 定期发送需求请求
-	leaseRespChan, err := p.client.KeepAlive(context.Background(), resp.ID)
+	leaseRespChan, err := p.client.KeepAlive(p.ctx, resp.ID)
 	if err != nil {
+		p.revoke(resp.ID)
 		return err
 	}
+	p.mu.Lock()
 	p.leaseID = resp.ID
 	p.keepAliveChan = leaseRespChan
-	go p.listenLeaseRespChan()
-	//log.Printf("Put key:%s  val:%s  success!", s.key, s.val)
+	p.mu.Unlock()
 	return nil
 }
 
-//ListenLeaseRespChan 监听 续租情况
+// revoke 撤销注册失败时申请的租约,避免每次重新注册都遗留一个租约
+func (p *EtcdPlugin) revoke(leaseID clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+	defer cancel()
+	if _, err := p.client.Revoke(ctx, leaseID); err != nil {
+		log.Rlog.Warn("[etcd plugin] revoke lease %x failed:%v", leaseID, err)
+	}
+}
+
+// listenLeaseRespChan 监听续租情况,续租通道关闭说明租约已过期或被撤销,按退避重新注册
 func (p *EtcdPlugin) listenLeaseRespChan() {
-	for leaseKeepResp := range p.keepAliveChan {
-		log.Rlog.Debug("[etcd plugin] %v", leaseKeepResp)
+	for {
+		p.mu.Lock()
+		ch := p.keepAliveChan
+		p.mu.Unlock()
+		for leaseKeepResp := range ch {
+			log.Rlog.Debug("[etcd plugin] %v", leaseKeepResp)
+		}
+		if p.ctx.Err() != nil {
+			return
+		}
+		p.mu.Lock()
+		log.Rlog.Warn("[etcd plugin] lease %x lost, register again", p.leaseID)
+		p.leaseID = 0
+		p.mu.Unlock()
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(reRegisterDelay(attempt)):
+			}
+			err := p.register()
+			if err == nil {
+				log.Rlog.Info("[etcd plugin] %v registered again", p.config.RpcServerAddr)
+				break
+			}
+			log.Rlog.Warn("[etcd plugin] register failed:%v, retry %v", err, attempt+1)
+		}
 	}
 }
 
+// reRegisterDelay 第 attempt 次重新注册前的等待时间,指数增长直到上限
+func reRegisterDelay(attempt int) time.Duration {
+	d := reRegisterBaseDelay
+	for i := 0; i < attempt && d < reRegisterMaxDelay; i++ {
+		d *= 2
+	}
+	if d > reRegisterMaxDelay {
+		d = reRegisterMaxDelay
+	}
+	return d
+}
+
 // Close 注销服务
 func (p *EtcdPlugin) Close() error {
+	p.cancel()
+	p.mu.Lock()
+	leaseID := p.leaseID
+	p.mu.Unlock()
 	//撤销租约
-	if _, err := p.client.Revoke(context.Background(), p.leaseID); err != nil {
-		return err
+	if leaseID != 0 {
+		if _, err := p.client.Revoke(context.Background(), leaseID); err != nil {
+			_ = p.client.Close()
+			return err
+		}
 	}
 	return p.client.Close()
-}
\ No newline at end of file
+}
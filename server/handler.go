@@ -3,8 +3,8 @@ package server
 import (
 	"context"
 	"github.com/arch3754/mrpc/log"
-	"github.com/arch3754/mrpc/util"
 	"reflect"
+	"sort"
 )
 
 type handler struct {
@@ -18,20 +18,44 @@ type method struct {
 	argTy   reflect.Type
 	replyTy reflect.Type
 	method  reflect.Method
+	stream  bool
 }
 
-func (s *Server) Register(service interface{}, name ...string) {
-	if len(name) > 0 {
-		hl := newHandler(service)
-		for _, v := range name {
-			if len(v) != 0 {
-				s.handlerMap[v] = hl
+func (s *Server) Register(service interface{}, name ...string) error {
+	hl := newHandler(service)
+	names := make([]string, 0, len(name))
+	for _, v := range name {
+		if len(v) != 0 {
+			names = append(names, v)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, hl.name)
+	}
+	methods := hl.methodNames()
+	var err error
+	for _, v := range names {
+		//插件注册成功后才提供服务,避免提供未被发布的服务;某个名字失败时继续注册其他名字
+		if e := s.doRegister(v, methods); e != nil {
+			log.Rlog.Error("register %v err:%v", v, e)
+			if err == nil {
+				err = e
 			}
+			continue
 		}
-		return
+		s.handlerMap[v] = hl
 	}
-	s.handlerMap[reflect.Indirect(reflect.ValueOf(service)).Type().Name()] = newHandler(service)
+	return err
+}
 
+// methodNames 按名字排序的方法列表
+func (h *handler) methodNames() []string {
+	methods := make([]string, 0, len(h.methodMap))
+	for m := range h.methodMap {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
 }
 
 // handlerName methodName arg reply meta
@@ -53,6 +77,14 @@ func (h *handler) installMethod(typ reflect.Type) map[string]*method {
 		//if len(m.PkgPath) == 0 {
 		//	continue
 		//}
+		if m.Type.NumIn() == 3 && m.Type.In(2) == streamType {
+			if !m.Type.In(1).Implements(reflect.TypeOf((*context.Context)(nil)).Elem()) || m.Type.NumOut() != 1 {
+				log.Rlog.Debug("handler(%v) stream method(%v) must be func(context.Context, Stream) error", h.name, m.Name)
+				continue
+			}
+			methods[m.Name] = &method{name: m.Name, method: m, stream: true}
+			continue
+		}
 		if m.Type.NumIn() != 4 {
 			log.Rlog.Debug("method[%v] args not enough", m.Name)
 			continue
@@ -82,12 +114,8 @@ func (h *handler) installMethod(typ reflect.Type) map[string]*method {
 	return methods
 }
 
+// call 调用服务方法,panic 由 Server.invoke 统一恢复
 func (h *handler) call(ctx context.Context, method string, arg, reply reflect.Value) error {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Rlog.Error("Recovery] panic recovered:\n%s\n%s", err, util.Stack(3))
-		}
-	}()
 	m := h.methodMap[method]
 	f := m.method.Func
 	v := f.Call([]reflect.Value{h.val, reflect.ValueOf(ctx), arg, reply})
@@ -97,3 +125,14 @@ func (h *handler) call(ctx context.Context, method string, arg, reply reflect.Va
 	}
 	return nil
 }
+
+// callStream 调用流式服务方法
+func (h *handler) callStream(ctx context.Context, method string, stream Stream) error {
+	m := h.methodMap[method]
+	v := m.method.Func.Call([]reflect.Value{h.val, reflect.ValueOf(ctx), reflect.ValueOf(stream)})
+	errInter := v[0].Interface()
+	if errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
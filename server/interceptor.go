@@ -0,0 +1,31 @@
+package server
+
+import "github.com/arch3754/mrpc/util"
+
+// UnaryHandler 执行拦截器链之后的服务方法
+type UnaryHandler func(ctx *util.Context, path, method string, arg, reply interface{}) error
+
+// UnaryServerInterceptor 服务端拦截器,在参数解码之后、服务方法调用之前执行,
+// 调用 next 继续后续拦截器及服务方法,不调用则直接返回
+type UnaryServerInterceptor func(ctx *util.Context, path, method string, arg, reply interface{}, next UnaryHandler) error
+
+// AddInterceptor 按添加顺序注册拦截器,先添加的在外层
+func (s *Server) AddInterceptor(interceptors ...UnaryServerInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// ChainUnaryServer 将多个拦截器合并为一个,第一个在最外层
+func ChainUnaryServer(interceptors ...UnaryServerInterceptor) UnaryServerInterceptor {
+	return func(ctx *util.Context, path, method string, arg, reply interface{}, next UnaryHandler) error {
+		return chainUnaryHandler(interceptors, next)(ctx, path, method, arg, reply)
+	}
+}
+
+func chainUnaryHandler(interceptors []UnaryServerInterceptor, final UnaryHandler) UnaryHandler {
+	if len(interceptors) == 0 {
+		return final
+	}
+	return func(ctx *util.Context, path, method string, arg, reply interface{}) error {
+		return interceptors[0](ctx, path, method, arg, reply, chainUnaryHandler(interceptors[1:], final))
+	}
+}
@@ -1,6 +1,155 @@
 package server
 
-type Plugin interface {
+import (
+	"context"
+	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/protocol"
+	"net"
+)
+
+// Plugin 服务端插件,按需实现下列接口,服务在对应阶段通过类型断言调用
+type Plugin interface{}
+
+// RegistryPlugin 服务注册插件,Serve 时注册,Shutdown/Close 时注销
+type RegistryPlugin interface {
 	ServiceRegister() error
 	Close() error
-}
\ No newline at end of file
+}
+
+// RegisterPlugin 服务 Register 时调用
+type RegisterPlugin interface {
+	Register(name string, methods []string) error
+}
+
+// PostConnAcceptPlugin 连接建立后调用,返回错误则关闭该连接
+type PostConnAcceptPlugin interface {
+	PostConnAccept(conn net.Conn) error
+}
+
+// PreReadRequestPlugin 读取请求前调用
+type PreReadRequestPlugin interface {
+	PreReadRequest(ctx context.Context) error
+}
+
+// PostReadRequestPlugin 读取请求后调用,err 为读取错误
+type PostReadRequestPlugin interface {
+	PostReadRequest(ctx context.Context, req *protocol.Message, err error) error
+}
+
+// PreHandlePlugin 处理请求前调用,返回错误则拒绝该请求并将错误返回给调用方
+type PreHandlePlugin interface {
+	PreHandle(ctx context.Context, req *protocol.Message) error
+}
+
+// PostHandlePlugin 处理请求后调用
+type PostHandlePlugin interface {
+	PostHandle(ctx context.Context, req *protocol.Message, resp *protocol.Message) error
+}
+
+// PreWriteResponsePlugin 写响应前调用
+type PreWriteResponsePlugin interface {
+	PreWriteResponse(ctx context.Context, req *protocol.Message, resp *protocol.Message) error
+}
+
+// PostWriteResponsePlugin 写响应后调用,err 为写入错误
+type PostWriteResponsePlugin interface {
+	PostWriteResponse(ctx context.Context, req *protocol.Message, resp *protocol.Message, err error) error
+}
+
+// ConnClosePlugin 连接关闭时调用
+type ConnClosePlugin interface {
+	ConnClose(conn net.Conn) error
+}
+
+func (s *Server) doRegister(name string, methods []string) error {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(RegisterPlugin); ok {
+			if err := plug.Register(name, methods); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) doPostConnAccept(conn net.Conn) error {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PostConnAcceptPlugin); ok {
+			if err := plug.PostConnAccept(conn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) doPreReadRequest(ctx context.Context) {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PreReadRequestPlugin); ok {
+			if err := plug.PreReadRequest(ctx); err != nil {
+				log.Rlog.Warn("plugin PreReadRequest err:%v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) doPostReadRequest(ctx context.Context, req *protocol.Message, e error) {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PostReadRequestPlugin); ok {
+			if err := plug.PostReadRequest(ctx, req, e); err != nil {
+				log.Rlog.Warn("plugin PostReadRequest err:%v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) doPreHandle(ctx context.Context, req *protocol.Message) error {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PreHandlePlugin); ok {
+			if err := plug.PreHandle(ctx, req); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) doPostHandle(ctx context.Context, req *protocol.Message, resp *protocol.Message) {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PostHandlePlugin); ok {
+			if err := plug.PostHandle(ctx, req, resp); err != nil {
+				log.Rlog.Warn("plugin PostHandle err:%v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) doPreWriteResponse(ctx context.Context, req *protocol.Message, resp *protocol.Message) {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PreWriteResponsePlugin); ok {
+			if err := plug.PreWriteResponse(ctx, req, resp); err != nil {
+				log.Rlog.Warn("plugin PreWriteResponse err:%v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) doPostWriteResponse(ctx context.Context, req *protocol.Message, resp *protocol.Message, e error) {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(PostWriteResponsePlugin); ok {
+			if err := plug.PostWriteResponse(ctx, req, resp, e); err != nil {
+				log.Rlog.Warn("plugin PostWriteResponse err:%v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) doConnClose(conn net.Conn) {
+	for _, p := range s.Plugins {
+		if plug, ok := p.(ConnClosePlugin); ok {
+			if err := plug.ConnClose(conn); err != nil {
+				log.Rlog.Warn("plugin ConnClose err:%v", err)
+			}
+		}
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	stderrors "errors"
 	"fmt"
 	"github.com/arch3754/mrpc/codec"
+	"github.com/arch3754/mrpc/errors"
 	"github.com/arch3754/mrpc/log"
 	"github.com/arch3754/mrpc/protocol"
 	"github.com/arch3754/mrpc/util"
@@ -13,32 +15,83 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultMaxConnInFlight 单连接默认最大并发处理请求数
+const DefaultMaxConnInFlight = 1024
+
+var (
+	// ErrServerClosed Shutdown/Close 之后 Serve 返回该错误
+	ErrServerClosed = stderrors.New("mrpc: server closed")
+	// ErrServiceNotFound 请求的 Path 未注册
+	ErrServiceNotFound = errors.New(errors.NotFound, "mrpc: service not found")
+	// ErrMethodNotFound 服务中不存在请求的 Method
+	ErrMethodNotFound = errors.New(errors.NotFound, "mrpc: method not found")
+	// ErrUnsupportedSerialize 请求头中的序列化方式不支持
+	ErrUnsupportedSerialize = errors.New(errors.InvalidArgument, "mrpc: unsupported serialize type")
+)
+
+var shutdownPollInterval = 50 * time.Millisecond
+
 type Server struct {
-	listener          net.Listener
-	Plugins           []Plugin
-	TlsConfig         *tls.Config
+	panicCount uint64 //首字段保证 32 位平台上原子操作的对齐
+	listener   net.Listener
+	Plugins    []Plugin
+	TlsConfig  *tls.Config
+	// MaxConnInFlight 单连接同时处理的最大请求数,<=0 表示不限制
+	MaxConnInFlight int
+	// Debug 开启后服务方法 panic 的堆栈会作为错误详情返回给调用方
+	Debug bool
+	// PanicHandler 服务方法 panic 时回调,可用于告警
+	PanicHandler      func(ctx context.Context, path, method string, recovered interface{}, stack []byte)
 	connReadIdleTime  time.Duration
 	connWriteIdleTime time.Duration
 	handlerMap        map[string]*handler
 	mu                sync.Mutex
-	activeConnMap     map[string]net.Conn
+	activeConnMap     map[string]*serverConn
+	inShutdown        int32
+	interceptors      []UnaryServerInterceptor
 }
 
 func NewServer(readIdleTimeout, writeIdleTimeout time.Duration) *Server {
 	return &Server{
 		handlerMap:        make(map[string]*handler),
-		activeConnMap:     make(map[string]net.Conn),
+		activeConnMap:     make(map[string]*serverConn),
+		MaxConnInFlight:   DefaultMaxConnInFlight,
 		connReadIdleTime:  readIdleTimeout,
 		connWriteIdleTime: writeIdleTimeout,
 	}
 }
-func (s *Server) AddPlugin(plugin Plugin) {
+
+// AddPlugin 添加插件,插件实现 RegisterPlugin 时补充注册之前已 Register 的服务,
+// 与 Register 一致,插件注册失败的服务不再提供,返回第一个错误
+func (s *Server) AddPlugin(plugin Plugin) error {
 	s.Plugins = append(s.Plugins, plugin)
+	plug, ok := plugin.(RegisterPlugin)
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(s.handlerMap))
+	for name := range s.handlerMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var err error
+	for _, name := range names {
+		if e := plug.Register(name, s.handlerMap[name].methodNames()); e != nil {
+			log.Rlog.Error("plugin register %v err:%v", name, e)
+			delete(s.handlerMap, name)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
 }
 func (s *Server) Serve(network, address string) error {
 	var ln net.Listener
@@ -51,66 +104,274 @@ func (s *Server) Serve(network, address string) error {
 	if err != nil {
 		return err
 	}
-	for _, plug := range s.Plugins {
-		if err := plug.ServiceRegister(); err != nil {
-			return err
+	for _, p := range s.Plugins {
+		if plug, ok := p.(RegistryPlugin); ok {
+			if err := plug.ServiceRegister(); err != nil {
+				return err
+			}
 		}
 	}
-	s.serveListener(ln)
-	return nil
+	return s.ServeListener(ln)
 }
 
-func (s *Server) serveListener(ln net.Listener) {
+// ServeListener 在已有的 listener 上提供服务,不会触发 RegistryPlugin 注册
+func (s *Server) ServeListener(ln net.Listener) error {
+	s.mu.Lock()
 	s.listener = ln
+	s.mu.Unlock()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			log.Rlog.Error("accept err:%v", err)
-			return
+			return err
 		}
-		s.mu.Lock()
-		s.activeConnMap[conn.RemoteAddr().String()] = conn
-		s.mu.Unlock()
 		if s.TlsConfig != nil {
 			if tlsConn, ok := conn.(*tls.Conn); ok {
 				if err = tlsConn.Handshake(); err != nil {
 					log.Rlog.Error("%v TLS handshake error: %v", conn.RemoteAddr(), err)
-					return
+					_ = conn.Close()
+					continue
 				}
 			}
 		}
+		if err = s.doPostConnAccept(conn); err != nil {
+			log.Rlog.Info("%v rejected by plugin: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			continue
+		}
 		go s.serveConn(conn)
+	}
+}
 
-		s.mu.Lock()
-		delete(s.activeConnMap, conn.RemoteAddr().String())
-		s.mu.Unlock()
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// Shutdown 优雅关闭:注销服务、停止接收新连接和新请求,等待处理中的请求完成后关闭连接,
+// ctx 到期后强制关闭剩余连接并返回 ctx.Err()。协议中没有 goaway 消息,空闲连接直接关闭,
+// 客户端读到连接关闭后重连或切换到其他服务端
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stop()
+	s.mu.Lock()
+	for _, conn := range s.activeConnMap {
+		//打断读循环,空闲连接随即关闭,繁忙连接在请求处理完后关闭
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.activeConnCount() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即关闭服务,不等待处理中的请求
+func (s *Server) Close() error {
+	err := s.stop()
+	s.closeConns()
+	return err
+}
+
+// stop 注销服务并关闭 listener,只在第一次 Shutdown/Close 时执行
+func (s *Server) stop() error {
+	if !atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1) {
+		return nil
+	}
+	var err error
+	//先注销服务,避免客户端继续路由到本节点
+	for _, p := range s.Plugins {
+		plug, ok := p.(RegistryPlugin)
+		if !ok {
+			continue
+		}
+		if e := plug.Close(); e != nil {
+			log.Rlog.Error("plugin close err:%v", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		if e := s.listener.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.activeConnMap {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) activeConnCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.activeConnMap)
+}
+
+// serverConn 串行化同一连接上的响应写入,并限制并发处理的请求数
+type serverConn struct {
+	net.Conn
+	writeMu      sync.Mutex
+	writeTimeout time.Duration
+	sem          chan struct{}
+	wg           sync.WaitGroup
+	streamMu     sync.Mutex
+	streams      map[uint64]*serverStream
+}
+
+func newServerConn(conn net.Conn, maxInFlight int, writeTimeout time.Duration) *serverConn {
+	sc := &serverConn{Conn: conn, writeTimeout: writeTimeout}
+	if maxInFlight > 0 {
+		sc.sem = make(chan struct{}, maxInFlight)
+	}
+	return sc
+}
+
+func (c *serverConn) acquire() {
+	if c.sem != nil {
+		c.sem <- struct{}{}
+	}
+	c.wg.Add(1)
+}
+
+func (c *serverConn) release() {
+	c.wg.Done()
+	if c.sem != nil {
+		<-c.sem
 	}
 }
+
+func (c *serverConn) writeMessage(msg *protocol.Message) error {
+	data := msg.Encode()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeTimeout > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.Write(*data)
+	return err
+}
+
 func (s *Server) serveConn(conn net.Conn) {
+	sc := newServerConn(conn, s.MaxConnInFlight, s.connWriteIdleTime)
+	key := conn.RemoteAddr().String()
+	s.mu.Lock()
+	s.activeConnMap[key] = sc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.activeConnMap, key)
+		s.mu.Unlock()
+	}()
+
 	r := bufio.NewReaderSize(conn, 1024)
 	for {
 		now := time.Now()
 		_ = conn.SetReadDeadline(now.Add(s.connReadIdleTime))
+		//Shutdown 会先置位再重置读超时,这里在设置超时之后检查,避免覆盖掉 Shutdown 的打断;
+		//还有未结束的流时继续读取这些流的消息,流全部结束后再退出
+		if s.shuttingDown() && !sc.hasStreams() {
+			break
+		}
 		ctx := util.WithValue(context.Background(), util.ConnPtr, conn)
+		s.doPreReadRequest(ctx)
 		req, err := s.readRequest(ctx, r)
+		s.doPostReadRequest(ctx, req, err)
+		if stderrors.Is(err, protocol.ErrUnsupportedCompress) {
+			//帧已完整读取,回复错误后继续处理后续请求
+			if req.MessageType().IsStream() {
+				if req.MessageType() == protocol.StreamOpen {
+					s.writeStreamResult(sc, req.Seq(), errors.Wrap(errors.InvalidArgument, err), nil)
+				}
+				protocol.FreeMsg(req)
+				continue
+			}
+			resp := req.Clone()
+			resp.SetMessageType(protocol.Response)
+			handlerError(resp, errors.Wrap(errors.InvalidArgument, err))
+			if err = sc.writeMessage(resp); err != nil {
+				log.Rlog.Error("conn %v err:%v", conn.RemoteAddr(), err)
+			}
+			protocol.FreeMsg(req)
+			protocol.FreeMsg(resp)
+			continue
+		}
 		if err != nil {
+			if s.shuttingDown() && sc.hasStreams() && isTimeout(err) {
+				continue
+			}
 			if err == io.EOF {
 				log.Rlog.Info("client closed the connection: %s", conn.RemoteAddr().String())
 			} else {
 				log.Rlog.Info("read request[%v] err: %v", conn.RemoteAddr().String(), err)
 			}
 			protocol.FreeMsg(req)
-			return
+			break
+		}
+		if s.shuttingDown() && (req.MessageType() == protocol.Request || req.MessageType() == protocol.StreamOpen) {
+			s.rejectRequest(sc, req)
+			continue
 		}
-		_ = conn.SetWriteDeadline(now.Add(s.connWriteIdleTime))
 		ctx = util.WithLocalValue(ctx, util.RequestTime, time.Now().Unix())
-		//todo 池化
-		s.serverRequest(ctx, req, conn, now)
+		if req.MessageType().IsStream() {
+			s.handleStreamMessage(ctx, req, sc)
+			continue
+		}
+		//达到并发上限时阻塞读取,对客户端形成背压
+		sc.acquire()
+		go func() {
+			defer sc.release()
+			s.serverRequest(ctx, req, sc)
+		}()
+	}
+	sc.closeStreams()
+	sc.wg.Wait()
+	_ = conn.Close()
+	s.doConnClose(conn)
+}
 
+// rejectRequest 关闭期间为等待流结束继续读取时,拒绝新的请求与流
+func (s *Server) rejectRequest(conn *serverConn, req *protocol.Message) {
+	defer protocol.FreeMsg(req)
+	err := errors.New(errors.Unavailable, "mrpc: server is shutting down")
+	if req.MessageType() == protocol.StreamOpen {
+		s.writeStreamResult(conn, req.Seq(), err, nil)
+		return
 	}
+	resp := req.Clone()
+	resp.SetMessageType(protocol.Response)
+	handlerError(resp, err)
+	if e := conn.writeMessage(resp); e != nil {
+		log.Rlog.Debug("conn %v err:%v", conn.RemoteAddr(), e)
+	}
+	protocol.FreeMsg(resp)
 }
 
-func (s *Server) serverRequest(ctx *util.Context, req *protocol.Message, conn net.Conn, now time.Time) {
+func isTimeout(err error) bool {
+	var ne net.Error
+	return stderrors.As(err, &ne) && ne.Timeout()
+}
+
+func (s *Server) serverRequest(ctx *util.Context, req *protocol.Message, conn *serverConn) {
 	if req.IsHbs() {
 		resp := req
 		resp.SetMessageType(protocol.Response)
@@ -119,8 +380,7 @@ func (s *Server) serverRequest(ctx *util.Context, req *protocol.Message, conn ne
 		}
 		resp.Metadata[util.CpuIdle] = fmt.Sprintf("%v", cpu.CpuIdle())
 
-		data := resp.Encode()
-		_, err := conn.Write(*data)
+		err := conn.writeMessage(resp)
 		if err != nil {
 			log.Rlog.Debug("hbs conn %v err:%v", conn.RemoteAddr(), err)
 		}
@@ -136,24 +396,30 @@ func (s *Server) serverRequest(ctx *util.Context, req *protocol.Message, conn ne
 		defer cancelFunc()
 	}
 
-	resp := s.handleRequest(ctx, req)
+	var resp *protocol.Message
+	if err := s.doPreHandle(ctx, req); err != nil {
+		resp = req.Clone()
+		resp.SetMessageType(protocol.Response)
+		handlerError(resp, err)
+	} else {
+		resp = s.handleRequest(ctx, req)
+	}
+	s.doPostHandle(ctx, req, resp)
 	if len(respMetaData) > 0 {
 		if resp.Metadata == nil {
-			resp.Metadata = make(map[string]string)
-		} else {
-			for k := range resp.Metadata {
-				delete(resp.Metadata, k)
-			}
+			resp.Metadata = make(map[string]string, len(respMetaData))
 		}
 		for k, v := range respMetaData {
-			resp.Metadata[k] = v
+			//保留 handlerError 写入的错误信息
+			if _, ok := resp.Metadata[k]; !ok {
+				resp.Metadata[k] = v
+			}
 		}
-	} else {
-		resp.Metadata = respMetaData
 	}
 
-	data := resp.Encode()
-	_, err := conn.Write(*data)
+	s.doPreWriteResponse(ctx, req, resp)
+	err := conn.writeMessage(resp)
+	s.doPostWriteResponse(ctx, req, resp, err)
 	if err != nil {
 		log.Rlog.Error("conn %v err:%v", conn.RemoteAddr(), err)
 	}
@@ -182,7 +448,11 @@ func parseServerTimeout(ctx *util.Context, req *protocol.Message) context.Cancel
 func (s *Server) readRequest(ctx context.Context, rd io.Reader) (*protocol.Message, error) {
 	req := protocol.GetMsg()
 	err := req.Decode(rd)
+	if stderrors.Is(err, protocol.ErrUnsupportedCompress) {
+		return req, err
+	}
 	if err != nil {
+		protocol.FreeMsg(req)
 		return nil, err
 	}
 	return req, nil
@@ -190,22 +460,30 @@ func (s *Server) readRequest(ctx context.Context, rd io.Reader) (*protocol.Messa
 func (s *Server) handleRequest(ctx context.Context, req *protocol.Message) *protocol.Message {
 	resp := req.Clone()
 	resp.SetMessageType(protocol.Response)
-	cdc := codec.CodecMap[req.Serialize()]
-
-	handle := s.handlerMap[req.Path]
-	md := handle.methodMap[req.Method]
+	cdc, handle, md, err := s.lookup(req)
+	if err == nil && md.stream {
+		err = errors.Errorf(errors.Unimplemented, "mrpc: %s.%s is a stream method", req.Path, req.Method)
+	}
+	if err != nil {
+		handlerError(resp, err)
+		return resp
+	}
 
 	var arg = argsReplyPools.Get(md.argTy)
-	err := cdc.Decode(req.Payload, arg)
+	err = cdc.Decode(req.Payload, arg)
 	if err != nil {
 		log.Rlog.Error("decode err:%v", err)
 		argsReplyPools.Put(md.argTy, arg)
-		handlerError(resp, err)
+		handlerError(resp, errors.Wrap(errors.InvalidArgument, err))
 		return resp
 	}
 
 	reply := argsReplyPools.Get(md.replyTy)
-	err = handle.call(ctx, req.Method, reflect.ValueOf(arg), reflect.ValueOf(reply))
+	uctx, ok := ctx.(*util.Context)
+	if !ok {
+		uctx = util.NewContext(ctx)
+	}
+	err = s.invoke(uctx, handle, req.Path, req.Method, arg, reply)
 	if err != nil {
 		argsReplyPools.Put(md.argTy, arg)
 		argsReplyPools.Put(md.replyTy, reply)
@@ -217,7 +495,7 @@ func (s *Server) handleRequest(ctx context.Context, req *protocol.Message) *prot
 	if err != nil {
 		argsReplyPools.Put(md.argTy, arg)
 		argsReplyPools.Put(md.replyTy, reply)
-		handlerError(resp, err)
+		handlerError(resp, errors.Wrap(errors.Internal, err))
 		return resp
 	}
 
@@ -226,10 +504,58 @@ func (s *Server) handleRequest(ctx context.Context, req *protocol.Message) *prot
 	resp.Payload = data
 	return resp
 }
+
+// lookup 查找请求对应的编解码器、服务和方法
+func (s *Server) lookup(req *protocol.Message) (codec.Codec, *handler, *method, error) {
+	cdc, ok := codec.CodecMap[req.Serialize()]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedSerialize, req.Serialize())
+	}
+	handle, ok := s.handlerMap[req.Path]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrServiceNotFound, req.Path)
+	}
+	md, ok := handle.methodMap[req.Method]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: %s.%s", ErrMethodNotFound, req.Path, req.Method)
+	}
+	return cdc, handle, md, nil
+}
+
+// invoke 执行拦截器链和服务方法,panic 转为 Internal 错误返回
+func (s *Server) invoke(ctx *util.Context, handle *handler, path, method string, arg, reply interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.handlePanic(ctx, path, method, r, util.Stack(3))
+		}
+	}()
+	return chainUnaryHandler(s.interceptors, func(ctx *util.Context, path, method string, arg, reply interface{}) error {
+		return handle.call(ctx, method, reflect.ValueOf(arg), reflect.ValueOf(reply))
+	})(ctx, path, method, arg, reply)
+}
+
+func (s *Server) handlePanic(ctx context.Context, path, method string, r interface{}, stack []byte) error {
+	atomic.AddUint64(&s.panicCount, 1)
+	log.Rlog.Error("Recovery] %s.%s panic recovered:\n%s\n%s", path, method, r, stack)
+	if s.PanicHandler != nil {
+		s.PanicHandler(ctx, path, method, r, stack)
+	}
+	err := errors.Errorf(errors.Internal, "mrpc: %s.%s panic: %v", path, method, r)
+	if s.Debug {
+		err = err.WithDetails(stack)
+	}
+	return err
+}
+
+// PanicCount 返回服务方法 panic 的累计次数
+func (s *Server) PanicCount() uint64 {
+	return atomic.LoadUint64(&s.panicCount)
+}
+
 func handlerError(resp *protocol.Message, err error) {
 	resp.SetStatus(protocol.Error)
 	if resp.Metadata == nil {
 		resp.Metadata = make(map[string]string)
 	}
-	resp.Metadata[util.ResponseError] = err.Error()
-}
\ No newline at end of file
+	errors.SetMetadata(resp.Metadata, err)
+}
@@ -1,13 +1,23 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"github.com/arch3754/mrpc/client"
 	"github.com/arch3754/mrpc/codec"
+	"github.com/arch3754/mrpc/errors"
 	"github.com/arch3754/mrpc/protocol"
+	"github.com/arch3754/mrpc/registry"
 	"github.com/arch3754/mrpc/util"
 	"go.etcd.io/etcd/clientv3"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -71,7 +81,9 @@ func TestHandleRequest(t *testing.T) {
 	req.Payload = data
 	server := NewServer(time.Minute,time.Minute)
 	server.Register(new(A), "")
-	res := server.handleRequest(context.Background(), req)
+	ctx := util.WithLocalValue(util.WithLocalValue(util.NewContext(context.Background()),
+		util.RequestMetaData, map[string]string{}), util.ResponseMetaData, map[string]string{})
+	res := server.handleRequest(ctx, req)
 
 	if res.Payload == nil {
 		t.Fatalf("expect reply but got %s", res.Payload)
@@ -88,4 +100,850 @@ func TestHandleRequest(t *testing.T) {
 		t.Fatalf("failed to decode response: %v", err)
 	}
 	t.Logf("reply:%v", reply)
-}
\ No newline at end of file
+}
+
+type Sleeper struct{}
+
+func (s *Sleeper) Sleep(ctx context.Context, arg *int64, reply *int64) error {
+	time.Sleep(time.Duration(*arg) * time.Millisecond)
+	*reply = *arg
+	return nil
+}
+
+func startTestServer(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(ln)
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln.Addr().String()
+}
+
+type testClient interface {
+	AsyncCall(ctx context.Context, path, method string, arg, reply interface{}) *client.Caller
+	SyncCall(ctx context.Context, path, method string, arg, reply interface{}) error
+	NewStream(ctx context.Context, path, method string) (client.Stream, error)
+	Close() error
+}
+
+func newTestClient(t *testing.T, addr string) testClient {
+	c := client.NewClient(&client.Option{
+		Serialize:      protocol.MsgPack,
+		ConnTimeout:    10 * time.Second,
+		ConnectTimeout: 3 * time.Second,
+		Compress:       protocol.None,
+	})
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestServeConnConcurrent(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.Register(new(Sleeper))
+	c := newTestClient(t, startTestServer(t, s))
+
+	ctx := context.Background()
+	var slowReply, fastReply int64
+	slow := c.AsyncCall(ctx, "Sleeper", "Sleep", int64(300), &slowReply)
+	fast := c.AsyncCall(ctx, "Sleeper", "Sleep", int64(0), &fastReply)
+
+	select {
+	case <-fast.Done:
+	case <-slow.Done:
+		t.Fatal("slow call finished before fast call")
+	}
+	<-slow.Done
+	if fast.Error != nil || slow.Error != nil {
+		t.Fatalf("unexpected err fast=%v slow=%v", fast.Error, slow.Error)
+	}
+	if fastReply != 0 || slowReply != 300 {
+		t.Fatalf("replies mismatched: fast=%v slow=%v", fastReply, slowReply)
+	}
+}
+
+func TestServeConnMaxInFlight(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.MaxConnInFlight = 1
+	s.Register(new(Sleeper))
+	c := newTestClient(t, startTestServer(t, s))
+
+	ctx := context.Background()
+	var slowReply, fastReply int64
+	slow := c.AsyncCall(ctx, "Sleeper", "Sleep", int64(200), &slowReply)
+	fast := c.AsyncCall(ctx, "Sleeper", "Sleep", int64(0), &fastReply)
+
+	select {
+	case <-slow.Done:
+	case <-fast.Done:
+		t.Fatal("fast call should wait for the in-flight slot")
+	}
+	<-fast.Done
+	if slowReply != 200 || fastReply != 0 {
+		t.Fatalf("replies mismatched: fast=%v slow=%v", fastReply, slowReply)
+	}
+}
+
+func TestServeConnManyConcurrent(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.Register(new(Sleeper))
+	c := newTestClient(t, startTestServer(t, s))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(n int64) {
+			defer wg.Done()
+			var reply int64
+			err := c.SyncCall(context.Background(), "Sleeper", "Sleep", n%20, &reply)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if reply != n%20 {
+				t.Errorf("expect %v got %v", n%20, reply)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
+
+type closePlugin struct {
+	closed int32
+}
+
+func (p *closePlugin) ServiceRegister() error { return nil }
+func (p *closePlugin) Close() error {
+	atomic.AddInt32(&p.closed, 1)
+	return nil
+}
+
+func TestShutdownDrainsInFlight(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	plug := &closePlugin{}
+	s.AddPlugin(plug)
+	s.Register(new(Sleeper))
+	addr := startTestServer(t, s)
+	c := newTestClient(t, addr)
+	idle := newTestClient(t, addr)
+	var reply int64
+	if err := idle.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	caller := c.AsyncCall(context.Background(), "Sleeper", "Sleep", int64(300), &reply)
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown err:%v", err)
+	}
+	<-caller.Done
+	if caller.Error != nil || reply != 300 {
+		t.Fatalf("in-flight call should finish, err=%v reply=%v", caller.Error, reply)
+	}
+	//Shutdown 之后再 Close 不会重复注销
+	if err := s.Close(); err != nil {
+		t.Fatalf("close after shutdown err:%v", err)
+	}
+	if n := atomic.LoadInt32(&plug.closed); n != 1 {
+		t.Fatalf("expect plugin Close called once, got %d", n)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("listener should be closed")
+	}
+}
+
+func TestShutdownForceClose(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.Register(new(Sleeper))
+	c := newTestClient(t, startTestServer(t, s))
+
+	var reply int64
+	caller := c.AsyncCall(context.Background(), "Sleeper", "Sleep", int64(2000), &reply)
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	select {
+	case <-caller.Done:
+		if caller.Error == nil {
+			t.Fatal("expect call to fail after force close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call not failed after force close")
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.ServeListener(ln) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != ErrServerClosed {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServerInterceptor(t *testing.T) {
+	var order []string
+	s := NewServer(time.Minute, time.Minute)
+	s.AddInterceptor(func(ctx *util.Context, path, method string, arg, reply interface{}, next UnaryHandler) error {
+		order = append(order, "outer:"+path+"."+method)
+		return next(ctx, path, method, arg, reply)
+	}, func(ctx *util.Context, path, method string, arg, reply interface{}, next UnaryHandler) error {
+		if *(arg.(*int64)) < 0 {
+			return fmt.Errorf("negative arg")
+		}
+		order = append(order, "inner")
+		err := next(ctx, path, method, arg, reply)
+		*(reply.(*int64)) *= 10
+		return err
+	})
+	s.Register(new(Sleeper))
+
+	c := newTestClient(t, startTestServer(t, s))
+	var reply int64
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 10 || len(order) != 2 || order[0] != "outer:Sleeper.Sleep" || order[1] != "inner" {
+		t.Fatalf("unexpected reply=%v order=%v", reply, order)
+	}
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(-1), &reply); err == nil {
+		t.Fatal("expect interceptor to reject request")
+	}
+}
+
+type hookPlugin struct {
+	mu       sync.Mutex
+	calls    []string
+	rejectIP bool
+}
+
+func (p *hookPlugin) record(name string) {
+	p.mu.Lock()
+	p.calls = append(p.calls, name)
+	p.mu.Unlock()
+}
+func (p *hookPlugin) has(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.calls {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+func (p *hookPlugin) Register(name string, methods []string) error {
+	p.record("Register:" + name + ":" + strings.Join(methods, ","))
+	return nil
+}
+func (p *hookPlugin) PostConnAccept(conn net.Conn) error {
+	p.record("PostConnAccept")
+	if p.rejectIP {
+		return fmt.Errorf("rejected")
+	}
+	return nil
+}
+func (p *hookPlugin) PreReadRequest(ctx context.Context) error {
+	p.record("PreReadRequest")
+	return nil
+}
+func (p *hookPlugin) PostReadRequest(ctx context.Context, req *protocol.Message, err error) error {
+	p.record("PostReadRequest")
+	return nil
+}
+func (p *hookPlugin) PreHandle(ctx context.Context, req *protocol.Message) error {
+	p.record("PreHandle")
+	if req.Metadata["token"] != "ok" {
+		return fmt.Errorf("unauthorized")
+	}
+	return nil
+}
+func (p *hookPlugin) PostHandle(ctx context.Context, req *protocol.Message, resp *protocol.Message) error {
+	p.record("PostHandle")
+	return nil
+}
+func (p *hookPlugin) PreWriteResponse(ctx context.Context, req *protocol.Message, resp *protocol.Message) error {
+	p.record("PreWriteResponse")
+	return nil
+}
+func (p *hookPlugin) PostWriteResponse(ctx context.Context, req *protocol.Message, resp *protocol.Message, err error) error {
+	p.record("PostWriteResponse")
+	return nil
+}
+func (p *hookPlugin) ConnClose(conn net.Conn) error {
+	p.record("ConnClose")
+	return nil
+}
+
+type failRegisterPlugin struct {
+	fail string
+}
+
+func (p *failRegisterPlugin) Register(name string, methods []string) error {
+	if name == p.fail {
+		return fmt.Errorf("register %v failed", name)
+	}
+	return nil
+}
+
+func TestRegisterPluginError(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.AddPlugin(&failRegisterPlugin{fail: "B"})
+	if err := s.Register(new(Sleeper), "A", "B", "C"); err == nil {
+		t.Fatal("expect register error")
+	}
+	//注册失败的名字不提供服务,其余名字照常注册
+	for name, want := range map[string]bool{"A": true, "B": false, "C": true} {
+		if _, ok := s.handlerMap[name]; ok != want {
+			t.Errorf("handler %v registered=%v, expect %v", name, ok, want)
+		}
+	}
+}
+
+func TestAddPluginAfterRegisterError(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	if err := s.Register(new(Sleeper), "A", "B", "C"); err != nil {
+		t.Fatal(err)
+	}
+	//Register 之后添加的插件拒绝的名字同样不再提供服务
+	if err := s.AddPlugin(&failRegisterPlugin{fail: "B"}); err == nil {
+		t.Fatal("expect AddPlugin error")
+	}
+	for name, want := range map[string]bool{"A": true, "B": false, "C": true} {
+		if _, ok := s.handlerMap[name]; ok != want {
+			t.Errorf("handler %v registered=%v, expect %v", name, ok, want)
+		}
+	}
+}
+
+func TestPluginHooks(t *testing.T) {
+	plug := &hookPlugin{}
+	s := NewServer(time.Minute, time.Minute)
+	s.AddPlugin(plug)
+	if err := s.Register(new(Sleeper)); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, startTestServer(t, s))
+
+	var reply int64
+	ctx := util.SetRequestMetadata(context.Background(), map[string]string{"token": "ok"})
+	if err := c.SyncCall(ctx, "Sleeper", "Sleep", int64(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+	ctx = util.SetRequestMetadata(context.Background(), map[string]string{"token": "bad"})
+	if err := c.SyncCall(ctx, "Sleeper", "Sleep", int64(1), &reply); err == nil {
+		t.Fatal("expect PreHandle to reject request")
+	}
+	_ = c.Close()
+	time.Sleep(50 * time.Millisecond)
+	for _, name := range []string{"Register:Sleeper:Sleep", "PostConnAccept", "PreReadRequest", "PostReadRequest",
+		"PreHandle", "PostHandle", "PreWriteResponse", "PostWriteResponse", "ConnClose"} {
+		if !plug.has(name) {
+			t.Errorf("hook %v not called", name)
+		}
+	}
+}
+
+func TestPluginRejectConn(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.AddPlugin(&hookPlugin{rejectIP: true})
+	s.Register(new(Sleeper))
+	c := newTestClient(t, startTestServer(t, s))
+	var reply int64
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.SyncCall(ctx, "Sleeper", "Sleep", int64(1), &reply); err == nil {
+		t.Fatal("expect rejected connection to fail")
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.Register(new(Sleeper))
+	conn, err := net.Dial("tcp", startTestServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	good, _ := codec.CodecMap[protocol.Json].Encode(int64(1))
+	tests := []struct {
+		name      string
+		path      string
+		method    string
+		serialize protocol.Serialize
+		compress  protocol.Compress
+		payload   []byte
+		expect    error
+	}{
+		{"unknown service", "Nope", "Sleep", protocol.Json, protocol.None, good, ErrServiceNotFound},
+		{"unknown method", "Sleeper", "Nope", protocol.Json, protocol.None, good, ErrMethodNotFound},
+		{"empty method", "Sleeper", "", protocol.Json, protocol.None, good, ErrMethodNotFound},
+		{"empty service", "", "Sleep", protocol.Json, protocol.None, good, ErrServiceNotFound},
+		{"unknown serialize", "Sleeper", "Sleep", protocol.Serialize(99), protocol.None, good, ErrUnsupportedSerialize},
+		{"unknown compress", "Sleeper", "Sleep", protocol.Json, protocol.Compress(99), good, protocol.ErrUnsupportedCompress},
+		{"unknown service and method", "Nope", "Nope", protocol.Json, protocol.None, good, ErrServiceNotFound},
+		{"unknown serialize and service", "Nope", "Sleep", protocol.Serialize(99), protocol.None, good, ErrUnsupportedSerialize},
+		{"unknown compress and service", "Nope", "Sleep", protocol.Json, protocol.Compress(99), good, protocol.ErrUnsupportedCompress},
+		{"bad payload", "Sleeper", "Sleep", protocol.Json, protocol.None, []byte("{"), nil},
+		{"valid", "Sleeper", "Sleep", protocol.Json, protocol.None, good, nil},
+	}
+	r := bufio.NewReader(conn)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := protocol.NewMessage()
+			req.SetMessageType(protocol.Request)
+			req.SetSeq(uint64(i))
+			req.SetSerialize(tt.serialize)
+			req.SetCompress(protocol.None)
+			req.Path = tt.path
+			req.Method = tt.method
+			req.Payload = tt.payload
+			data := req.Encode()
+			//Encode 会跳过未知压缩方式,这里直接改写头部
+			(*data)[3] = byte(tt.compress)
+			if _, err := conn.Write(*data); err != nil {
+				t.Fatal(err)
+			}
+			resp := protocol.NewMessage()
+			if err := resp.Decode(r); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Seq() != uint64(i) {
+				t.Fatalf("expect seq %v got %v", i, resp.Seq())
+			}
+			msg := resp.Metadata[util.ResponseError]
+			switch {
+			case tt.name == "valid":
+				if resp.Status() != protocol.Normal {
+					t.Fatalf("expect normal status, got err %v", msg)
+				}
+			case tt.expect == nil:
+				if resp.Status() != protocol.Error || msg == "" {
+					t.Fatalf("expect error response, got status %v", resp.Status())
+				}
+			default:
+				if resp.Status() != protocol.Error || !strings.Contains(msg, tt.expect.Error()) {
+					t.Fatalf("expect %v, got status %v err %q", tt.expect, resp.Status(), msg)
+				}
+			}
+		})
+	}
+}
+
+type Validator struct{}
+
+func (v *Validator) Check(ctx context.Context, arg *int64, reply *int64) error {
+	if *arg < 0 {
+		return errors.New(errors.InvalidArgument, "arg must not be negative").WithDetails([]byte("arg"))
+	}
+	return fmt.Errorf("plain failure")
+}
+
+func TestErrorCodeOverWire(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.Register(new(Validator))
+	s.Register(new(Sleeper))
+	c := newTestClient(t, startTestServer(t, s))
+
+	var reply int64
+	err := c.SyncCall(context.Background(), "Validator", "Check", int64(-1), &reply)
+	var e *errors.Error
+	if !stderrors.As(err, &e) || e.Code != errors.InvalidArgument || string(e.Details) != "arg" {
+		t.Fatalf("expect InvalidArgument with details, got %#v", err)
+	}
+	err = c.SyncCall(context.Background(), "Validator", "Check", int64(1), &reply)
+	if errors.CodeOf(err) != errors.Unknown || err.Error() != "plain failure" {
+		t.Fatalf("expect Unknown, got %v %v", errors.CodeOf(err), err)
+	}
+	err = c.SyncCall(context.Background(), "Validator", "Nope", int64(1), &reply)
+	if !stderrors.Is(err, errors.ErrNotFound) {
+		t.Fatalf("expect NotFound, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.SyncCall(ctx, "Sleeper", "Sleep", int64(300), &reply)
+	if !stderrors.Is(err, errors.ErrDeadlineExceeded) || !stderrors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+}
+
+type Panicker struct{}
+
+func (p *Panicker) Boom(ctx context.Context, arg *int64, reply *int64) error {
+	var m map[string]int
+	m["boom"] = 1
+	return nil
+}
+
+func TestHandlerPanic(t *testing.T) {
+	s := NewServer(time.Minute, time.Minute)
+	s.Register(new(Panicker))
+	var alerted int32
+	s.PanicHandler = func(ctx context.Context, path, method string, recovered interface{}, stack []byte) {
+		if path == "Panicker" && method == "Boom" && len(stack) > 0 {
+			atomic.AddInt32(&alerted, 1)
+		}
+	}
+	c := newTestClient(t, startTestServer(t, s))
+
+	var reply int64
+	err := c.SyncCall(context.Background(), "Panicker", "Boom", int64(1), &reply)
+	var e *errors.Error
+	if !stderrors.As(err, &e) || e.Code != errors.Internal || len(e.Details) != 0 {
+		t.Fatalf("expect Internal without stack, got %#v", err)
+	}
+
+	s.Debug = true
+	err = c.SyncCall(context.Background(), "Panicker", "Boom", int64(1), &reply)
+	if !stderrors.As(err, &e) || e.Code != errors.Internal || !strings.Contains(string(e.Details), "Boom") {
+		t.Fatalf("expect Internal with stack, got %#v", err)
+	}
+	if s.PanicCount() != 2 || atomic.LoadInt32(&alerted) != 2 {
+		t.Fatalf("expect 2 panics, got count=%v alerted=%v", s.PanicCount(), alerted)
+	}
+}
+
+type Streamer struct{}
+
+func (s *Streamer) Echo(ctx context.Context, stream Stream) error {
+	for {
+		var n int64
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := stream.Send(n * 2); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Streamer) Push(ctx context.Context, stream Stream) error {
+	var count int64
+	if err := stream.Recv(&count); err != nil {
+		return err
+	}
+	payload := strings.Repeat("x", 1024)
+	for i := int64(0); i < count; i++ {
+		if err := stream.Send(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Streamer) Fail(ctx context.Context, stream Stream) error {
+	return errors.New(errors.PermissionDenied, "no stream for you")
+}
+
+func (s *Streamer) Wait(ctx context.Context, stream Stream) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func newStreamServer(t *testing.T) (*Server, testClient) {
+	s := NewServer(time.Minute, time.Minute)
+	if err := s.Register(new(Streamer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(Sleeper)); err != nil {
+		t.Fatal(err)
+	}
+	return s, newTestClient(t, startTestServer(t, s))
+}
+
+func TestStreamEcho(t *testing.T) {
+	_, c := newStreamServer(t)
+	st, err := c.NewStream(context.Background(), "Streamer", "Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 10; i++ {
+		if err := st.Send(i); err != nil {
+			t.Fatal(err)
+		}
+		var reply int64
+		if err := st.Recv(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != i*2 {
+			t.Fatalf("expect %d, got %d", i*2, reply)
+		}
+	}
+	if err := st.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var reply int64
+	if err := st.Recv(&reply); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	_, c := newStreamServer(t)
+	st, err := c.NewStream(context.Background(), "Streamer", "Push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 远超一个窗口,客户端不读时服务端应被阻塞而不是占满连接
+	const count = 1024
+	if err := st.Send(int64(count)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	var reply int64
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("unary call blocked by stream for %v", d)
+	}
+
+	for i := 0; i < count; i++ {
+		var s string
+		if err := st.Recv(&s); err != nil {
+			t.Fatalf("recv %d: %v", i, err)
+		}
+	}
+	var s string
+	if err := st.Recv(&s); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+}
+
+func TestStreamHandlerError(t *testing.T) {
+	_, c := newStreamServer(t)
+	st, err := c.NewStream(context.Background(), "Streamer", "Fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply int64
+	err = st.Recv(&reply)
+	if errors.CodeOf(err) != errors.PermissionDenied {
+		t.Fatalf("expect PermissionDenied, got %v", err)
+	}
+	if err.Error() != "no stream for you" {
+		t.Fatalf("unexpected message: %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	_, c := newStreamServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	st, err := c.NewStream(ctx, "Streamer", "Wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		var reply int64
+		done <- st.Recv(&reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if errors.CodeOf(err) != errors.Canceled {
+			t.Fatalf("expect Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Recv not unblocked by cancel")
+	}
+	// 服务端收到取消后连接仍可用
+	var reply int64
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEtcdPluginInstance(t *testing.T) {
+	p := &EtcdPlugin{config: &EtcdConfig{
+		RpcServerAddr: "tcp@10.0.0.1:8888",
+		Weight:        5,
+		Version:       "v1",
+		Zone:          "sh-a",
+		Tags:          []string{"canary"},
+	}}
+	s := NewServer(time.Minute, time.Minute)
+	s.AddPlugin(p)
+	if err := s.Register(new(Sleeper)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(new(A)); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := p.instance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := inst.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := registry.ParseInstance(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key() != "tcp@10.0.0.1:8888" || got.Weight != 5 || got.Zone != "sh-a" || !got.HasTag("canary") {
+		t.Fatalf("unexpected instance %+v", got)
+	}
+	if strings.Join(got.Services, ",") != "A,Sleeper" {
+		t.Fatalf("unexpected services %v", got.Services)
+	}
+	if !got.SupportsCodec(protocol.MsgPack) || !got.SupportsCodec(protocol.Json) {
+		t.Fatalf("unexpected codecs %v", got.Codecs)
+	}
+	p.config.BasePath = "/mrpc"
+	if k := p.key("A"); k != "/mrpc/A/tcp@10.0.0.1:8888" {
+		t.Fatalf("unexpected key %v", k)
+	}
+}
+
+func TestEtcdPluginRegisterAfterService(t *testing.T) {
+	p := &EtcdPlugin{config: &EtcdConfig{RpcServerAddr: "tcp@10.0.0.1:8888"}}
+	//没有服务时不写入空的注册信息,也不访问 etcd
+	if err := p.ServiceRegister(); err != errNoService {
+		t.Fatalf("expect errNoService, got %v", err)
+	}
+	s := NewServer(time.Minute, time.Minute)
+	if err := s.Register(new(Sleeper)); err != nil {
+		t.Fatal(err)
+	}
+	//插件在 Register 之后添加时补充注册已有的服务
+	s.AddPlugin(p)
+	inst, err := p.instance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(inst.Services, ",") != "Sleeper" {
+		t.Fatalf("unexpected services %v", inst.Services)
+	}
+}
+
+func TestEtcdPluginLegacyLayout(t *testing.T) {
+	p := &EtcdPlugin{config: &EtcdConfig{BasePath: "/mrpc", RpcServerAddr: "tcp@10.0.0.1:8888", LegacyLayout: true}}
+	if err := p.Register("Sleeper", nil); err != nil {
+		t.Fatal(err)
+	}
+	ops, err := p.ops(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || string(ops[0].KeyBytes()) != "/mrpc/tcp@10.0.0.1:8888" {
+		t.Fatalf("unexpected ops %+v", ops)
+	}
+	//旧版本客户端按 network@addr 解析值
+	if arr := strings.Split(string(ops[0].ValueBytes()), "@"); len(arr) != 2 || arr[0] != "tcp" || arr[1] != "10.0.0.1:8888" {
+		t.Fatalf("old clients cannot parse %q", ops[0].ValueBytes())
+	}
+	//新版本客户端同样可以解析旧格式
+	if inst, err := registry.ParseInstance(string(ops[0].ValueBytes())); err != nil || inst.Key() != "tcp@10.0.0.1:8888" {
+		t.Fatalf("unexpected instance %+v %v", inst, err)
+	}
+
+	p.config.LegacyLayout = false
+	if ops, err = p.ops(1); err != nil || len(ops) != 1 || string(ops[0].KeyBytes()) != "/mrpc/Sleeper/tcp@10.0.0.1:8888" {
+		t.Fatalf("unexpected ops %+v %v", ops, err)
+	}
+}
+
+func TestReRegisterDelay(t *testing.T) {
+	if d := reRegisterDelay(0); d != reRegisterBaseDelay {
+		t.Fatalf("unexpected first delay %v", d)
+	}
+	if d := reRegisterDelay(2); d != 4*reRegisterBaseDelay {
+		t.Fatalf("unexpected delay %v", d)
+	}
+	if d := reRegisterDelay(100); d != reRegisterMaxDelay {
+		t.Fatalf("expect delay capped, got %v", d)
+	}
+}
+
+func TestShutdownWaitsForStream(t *testing.T) {
+	s, c := newStreamServer(t)
+	st, err := c.NewStream(context.Background(), "Streamer", "Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func(n int64) {
+		if err := st.Send(n); err != nil {
+			t.Fatal(err)
+		}
+		var reply int64
+		if err := st.Recv(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != n*2 {
+			t.Fatalf("expect %d, got %d", n*2, reply)
+		}
+	}
+	echo(1)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	//关闭期间已打开的流继续收发,新的请求被拒绝
+	echo(2)
+	var reply int64
+	if err := c.SyncCall(context.Background(), "Sleeper", "Sleep", int64(0), &reply); errors.CodeOf(err) != errors.Unavailable {
+		t.Fatalf("expect unavailable during shutdown, got %v", err)
+	}
+	echo(3)
+	if err := st.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Recv(&reply); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("shutdown err:%v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown not finished after stream ended")
+	}
+}
+
+func TestShutdownForceCloseStream(t *testing.T) {
+	s, c := newStreamServer(t)
+	st, err := c.NewStream(context.Background(), "Streamer", "Wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	var reply int64
+	if err := st.Recv(&reply); err == nil || err == io.EOF {
+		t.Fatalf("expect stream aborted, got %v", err)
+	}
+}
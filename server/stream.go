@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"github.com/arch3754/mrpc/codec"
+	"github.com/arch3754/mrpc/errors"
+	"github.com/arch3754/mrpc/log"
+	"github.com/arch3754/mrpc/protocol"
+	"github.com/arch3754/mrpc/util"
+	"io"
+	"reflect"
+	"time"
+)
+
+// Stream 服务端流,流式服务方法签名为 func(ctx context.Context, stream server.Stream) error,
+// 方法返回即结束流,返回的错误作为流的最终结果发给客户端
+type Stream interface {
+	Context() context.Context
+	// Send 发送一条消息,发送窗口耗尽时阻塞直到客户端消费
+	Send(m interface{}) error
+	// Recv 接收一条消息,客户端 CloseSend 后返回 io.EOF
+	Recv(m interface{}) error
+	// CloseSend 不再发送,之后仍可 Recv,流在方法返回时结束
+	CloseSend() error
+}
+
+var streamType = reflect.TypeOf((*Stream)(nil)).Elem()
+
+type serverStream struct {
+	ctx        *util.Context
+	cancel     context.CancelFunc
+	conn       *serverConn
+	seq        uint64
+	serialize  protocol.Serialize
+	compress   protocol.Compress
+	codec      codec.Codec
+	sendWindow *protocol.SendWindow
+	recv       *protocol.RecvBuffer
+}
+
+func (st *serverStream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *serverStream) Send(m interface{}) error {
+	data, err := st.codec.Encode(m)
+	if err != nil {
+		return errors.Wrap(errors.Internal, err)
+	}
+	if err = st.sendWindow.Acquire(st.ctx, len(data)); err != nil {
+		return errors.FromError(err)
+	}
+	msg := protocol.NewStreamMessage(protocol.StreamData, st.seq)
+	msg.SetSerialize(st.serialize)
+	msg.SetCompress(st.compress)
+	msg.Payload = data
+	return st.conn.writeMessage(msg)
+}
+
+func (st *serverStream) Recv(m interface{}) error {
+	payload, update, err := st.recv.Pop(st.ctx)
+	if err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return errors.FromError(err)
+	}
+	if update > 0 {
+		if err = st.conn.writeMessage(protocol.NewWindowUpdate(st.seq, update)); err != nil {
+			log.Rlog.Debug("stream %v window update err:%v", st.seq, err)
+		}
+	}
+	if err = st.codec.Decode(payload, m); err != nil {
+		return errors.Wrap(errors.InvalidArgument, err)
+	}
+	return nil
+}
+
+func (st *serverStream) CloseSend() error {
+	st.sendWindow.Close(errors.New(errors.FailedPrecondition, "mrpc: send on closed stream"))
+	return nil
+}
+
+// abort 连接关闭或客户端取消时结束流
+func (st *serverStream) abort(err error) {
+	st.cancel()
+	st.recv.CloseWithError(err)
+	st.sendWindow.Close(err)
+}
+
+func (c *serverConn) addStream(st *serverStream) {
+	c.streamMu.Lock()
+	if c.streams == nil {
+		c.streams = make(map[uint64]*serverStream)
+	}
+	c.streams[st.seq] = st
+	c.streamMu.Unlock()
+}
+
+func (c *serverConn) getStream(seq uint64) *serverStream {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	return c.streams[seq]
+}
+
+func (c *serverConn) removeStream(seq uint64) {
+	c.streamMu.Lock()
+	delete(c.streams, seq)
+	c.streamMu.Unlock()
+}
+
+func (c *serverConn) hasStreams() bool {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	return len(c.streams) > 0
+}
+
+func (c *serverConn) closeStreams() {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	for _, st := range c.streams {
+		st.abort(errors.New(errors.Unavailable, "mrpc: connection closed"))
+	}
+}
+
+// handleStreamMessage 处理流相关的消息,除打开流外都不会阻塞读循环
+func (s *Server) handleStreamMessage(ctx *util.Context, msg *protocol.Message, conn *serverConn) {
+	defer protocol.FreeMsg(msg)
+	if msg.MessageType() == protocol.StreamOpen {
+		s.openStream(ctx, msg, conn)
+		return
+	}
+	st := conn.getStream(msg.Seq())
+	if st == nil {
+		//流已结束,丢弃迟到的消息
+		return
+	}
+	switch msg.MessageType() {
+	case protocol.StreamData:
+		st.recv.Push(msg.Payload)
+	case protocol.StreamHalfClose:
+		st.recv.CloseWithError(io.EOF)
+	case protocol.StreamCancel:
+		st.abort(errors.New(errors.Canceled, "mrpc: stream canceled by client"))
+	case protocol.StreamWindowUpdate:
+		st.sendWindow.Release(int64(protocol.WindowUpdateSize(msg)))
+	}
+}
+
+func (s *Server) openStream(ctx *util.Context, req *protocol.Message, conn *serverConn) {
+	cdc, handle, md, err := s.lookup(req)
+	if err == nil && !md.stream {
+		err = errors.Errorf(errors.Unimplemented, "mrpc: %s.%s is not a stream method", req.Path, req.Method)
+	}
+	if err != nil {
+		s.writeStreamResult(conn, req.Seq(), err, nil)
+		return
+	}
+	respMetaData := make(map[string]string)
+	ctx = util.WithLocalValue(util.WithLocalValue(ctx, util.RequestMetaData, req.Metadata),
+		util.ResponseMetaData, respMetaData)
+	if err = s.doPreHandle(ctx, req); err != nil {
+		s.writeStreamResult(conn, req.Seq(), err, nil)
+		return
+	}
+	timeoutCancel := parseServerTimeout(ctx, req)
+	streamCtx, cancel := context.WithCancel(ctx.Context)
+	ctx.Context = streamCtx
+	st := &serverStream{
+		ctx:        ctx,
+		cancel:     cancel,
+		conn:       conn,
+		seq:        req.Seq(),
+		serialize:  req.Serialize(),
+		compress:   req.Compress(),
+		codec:      cdc,
+		sendWindow: protocol.NewSendWindow(protocol.DefaultStreamWindow),
+		recv:       protocol.NewRecvBuffer(protocol.DefaultStreamWindow),
+	}
+	conn.addStream(st)
+	//流不占用并发槽位,但仍计入连接的处理中任务;Shutdown 期间读循环继续读取流的消息,
+	//等待流结束,ctx 到期强制关闭连接时才中止流
+	conn.wg.Add(1)
+	//req 在返回后会被回收,不能在协程中引用
+	path, method := req.Path, req.Method
+	go func() {
+		defer conn.wg.Done()
+		err := s.invokeStream(ctx, handle, path, method, st)
+		conn.removeStream(st.seq)
+		if s.shuttingDown() && !conn.hasStreams() {
+			//唤醒等待流结束的读循环
+			_ = conn.SetReadDeadline(time.Now())
+		}
+		cancel()
+		if timeoutCancel != nil {
+			timeoutCancel()
+		}
+		s.writeStreamResult(conn, st.seq, err, respMetaData)
+	}()
+}
+
+// invokeStream 调用流式服务方法,panic 转为 Internal 错误返回
+func (s *Server) invokeStream(ctx *util.Context, handle *handler, path, method string, st *serverStream) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.handlePanic(ctx, path, method, r, util.Stack(3))
+		}
+	}()
+	return handle.callStream(ctx, method, st)
+}
+
+// writeStreamResult 发送服务端的 StreamHalfClose,携带流的最终结果和响应元数据
+func (s *Server) writeStreamResult(conn *serverConn, seq uint64, err error, meta map[string]string) {
+	msg := protocol.NewStreamMessage(protocol.StreamHalfClose, seq)
+	if err != nil {
+		handlerError(msg, err)
+	}
+	if len(meta) > 0 {
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string, len(meta))
+		}
+		for k, v := range meta {
+			if _, ok := msg.Metadata[k]; !ok {
+				msg.Metadata[k] = v
+			}
+		}
+	}
+	if err = conn.writeMessage(msg); err != nil {
+		log.Rlog.Debug("conn %v write stream result err:%v", conn.RemoteAddr(), err)
+	}
+}
@@ -8,14 +8,16 @@ import (
 )
 
 const (
-	RequestMetaData    = "__request_metadata"
-	ResponseMetaData   = "__response_metadata"
-	RequestTime        = "__request_time"
-	ResponseError      = "__response_error"
-	DefaultRpcBasePath = "__rpc_base_path"
-	ConnPtr            = "__conn"
-	ServerTimeout      = "__server_timeout"
-	CpuIdle            = "__cpu_idle"
+	RequestMetaData      = "__request_metadata"
+	ResponseMetaData     = "__response_metadata"
+	RequestTime          = "__request_time"
+	ResponseError        = "__response_error"
+	ResponseErrorCode    = "__response_error_code"
+	ResponseErrorDetails = "__response_error_details"
+	DefaultRpcBasePath   = "__rpc_base_path"
+	ConnPtr              = "__conn"
+	ServerTimeout        = "__server_timeout"
+	CpuIdle              = "__cpu_idle"
 )
 
 var (
@@ -72,4 +74,4 @@ func function(pc uintptr) []byte {
 	}
 	name = bytes.Replace(name, centerDot, dot, -1)
 	return name
-}
\ No newline at end of file
+}